@@ -0,0 +1,243 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"math/big"
+	"net/netip"
+	"slices"
+
+	"github.com/aromatt/netipds"
+)
+
+// commonSupernet returns the longest Prefix that contains both a and b. The
+// Prefixes must be of the same address family.
+func commonSupernet(a, b netip.Prefix) netip.Prefix {
+	for bits := min(a.Bits(), b.Bits()); ; bits-- {
+		s := netip.PrefixFrom(a.Addr(), bits).Masked()
+		if s.Contains(b.Addr()) {
+			return s
+		}
+	}
+}
+
+// aggregateCandidate is the supernet of a Prefix in the working list and the
+// next one, and the number of extra addresses merging them would add.
+type aggregateCandidate struct {
+	supernet netip.Prefix
+	extra    *big.Int
+	ok       bool
+}
+
+// aggregateItem is a heap entry for the candidate merge of a node in the
+// working list and the next node. It is stale if its version is no longer the
+// node's version, i.e. if the candidate has since changed.
+type aggregateItem struct {
+	node    int
+	version int
+	extra   *big.Int
+	addr    netip.Addr
+}
+
+// aggregateHeap orders candidate merges by the fewest extra addresses, then by
+// the lowest address.
+type aggregateHeap []aggregateItem
+
+func (h aggregateHeap) Len() int { return len(h) }
+
+func (h aggregateHeap) Less(i, j int) bool {
+	if c := h[i].extra.Cmp(h[j].extra); c != 0 {
+		return c < 0
+	}
+	return h[i].addr.Less(h[j].addr)
+}
+
+func (h aggregateHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *aggregateHeap) Push(x any) { *h = append(*h, x.(aggregateItem)) }
+
+func (h *aggregateHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// AggregatePrefixes merges sorted, non-overlapping Prefixes into at most
+// maxPrefixes supernets, greedily choosing the merges which add the fewest
+// addresses not covered by the original Prefixes. Supernets shorter than
+// minBits, or which overlap forbid (excluding any part of forbid covered by the
+// original Prefixes), are never produced. The aggregated Prefixes are returned
+// along with the number of extra addresses they cover.
+func AggregatePrefixes(
+	prefixes []netip.Prefix,
+	maxPrefixes int,
+	minBits int,
+	forbid *netipds.PrefixSet,
+) ([]netip.Prefix, *big.Int, error) {
+	// Only address space newly covered by a supernet can be forbidden
+	orig := netipds.PrefixSetBuilder{}
+	for _, p := range prefixes {
+		orig.Add(p)
+	}
+	forbidPsb := netipds.PrefixSetBuilder{}
+	forbidPsb.Merge(forbid)
+	PrefixSetBuilderSubtract(&forbidPsb, orig.PrefixSet())
+	forbid = forbidPsb.PrefixSet()
+
+	// The working list is a linked list of nodes, so that merged runs can be
+	// replaced in constant time. A next or prev of -1 means there is none.
+	working := slices.Clone(prefixes)
+	n := len(working)
+	next, prev := make([]int, n), make([]int, n)
+	for i := range working {
+		next[i], prev[i] = i+1, i-1
+	}
+	if n > 0 {
+		next[n-1] = -1
+	}
+	removed := make([]bool, n)
+	remaining := n
+
+	// run returns the first and last nodes of the run which would be replaced
+	// by s, the supernet of node i and the next node.
+	run := func(i int, s netip.Prefix) (int, int) {
+		first, last := i, next[i]
+		for prev[first] >= 0 && s.Overlaps(working[prev[first]]) {
+			first = prev[first]
+		}
+		for next[last] >= 0 && s.Overlaps(working[next[last]]) {
+			last = next[last]
+		}
+		return first, last
+	}
+
+	// candidates[i] describes the merge of node i and the next node. Since
+	// the nodes are sorted, only one pair of adjacent nodes can have a given
+	// supernet, so bySupernet maps each supernet to its candidate.
+	candidates := make([]aggregateCandidate, n)
+	versions := make([]int, n)
+	bySupernet := map[netip.Prefix]int{}
+	h := aggregateHeap{}
+	push := func(i int) {
+		versions[i]++
+		if candidates[i].ok {
+			heap.Push(&h, aggregateItem{i, versions[i], candidates[i].extra, working[i].Addr()})
+		}
+	}
+	update := func(i int) {
+		candidates[i] = aggregateCandidate{}
+		if j := next[i]; j >= 0 && working[i].Addr().BitLen() == working[j].Addr().BitLen() {
+			s := commonSupernet(working[i], working[j])
+			if s.Bits() >= minBits && !forbid.OverlapsPrefix(s) {
+				first, last := run(i, s)
+				extra := PrefixSize(s)
+				for k := first; ; k = next[k] {
+					extra.Sub(extra, PrefixSize(working[k]))
+					if k == last {
+						break
+					}
+				}
+				candidates[i] = aggregateCandidate{s, extra, true}
+				bySupernet[s] = i
+			}
+		}
+		push(i)
+	}
+	for i := range working {
+		update(i)
+	}
+
+	totalExtra := big.NewInt(0)
+	for remaining > maxPrefixes {
+		if h.Len() == 0 {
+			return nil, nil, fmt.Errorf(
+				"Cannot aggregate into %d prefixes", maxPrefixes)
+		}
+		item := heap.Pop(&h).(aggregateItem)
+		if removed[item.node] || item.version != versions[item.node] {
+			continue
+		}
+		s, extra := candidates[item.node].supernet, candidates[item.node].extra
+		totalExtra.Add(totalExtra, extra)
+
+		// Replace the merged nodes with their supernet, reusing the first
+		first, last := run(item.node, s)
+		for k := next[first]; ; k = next[k] {
+			removed[k] = true
+			remaining--
+			if k == last {
+				break
+			}
+		}
+		working[first], next[first] = s, next[last]
+		if next[first] >= 0 {
+			prev[next[first]] = first
+		}
+
+		// Any other candidate overlapping the supernet must encompass it, and
+		// so now adds fewer extra addresses. Then update the candidates which
+		// involve the supernet.
+		for bits := s.Bits() - 1; bits >= 0; bits-- {
+			a := netip.PrefixFrom(s.Addr(), bits).Masked()
+			i, ok := bySupernet[a]
+			if !ok || removed[i] || i == first || i == prev[first] ||
+				!candidates[i].ok || candidates[i].supernet != a {
+				continue
+			}
+			candidates[i].extra = new(big.Int).Sub(candidates[i].extra, extra)
+			push(i)
+		}
+		update(first)
+		if prev[first] >= 0 {
+			update(prev[first])
+		}
+	}
+
+	aggregated := make([]netip.Prefix, 0, remaining)
+	for i := 0; i >= 0 && i < n; i = next[i] {
+		aggregated = append(aggregated, working[i])
+	}
+	return aggregated, totalExtra, nil
+}
+
+// SplitPrefixesTo splits each of prefixes which is shorter than bits into its
+// subnets of length bits (or into single IPs, if bits is longer than the
+// Prefix's address family allows).
+func SplitPrefixesTo(prefixes []netip.Prefix, bits int) []netip.Prefix {
+	split := []netip.Prefix{}
+	for _, p := range prefixes {
+		EachSubnet(p, min(bits, p.Addr().BitLen()), func(sub netip.Prefix) {
+			split = append(split, sub)
+		})
+	}
+	return split
+}
+
+// MergeSiblings replaces each pair of sibling Prefixes (the two halves of a
+// common parent) with their parent, as long as the parent is no shorter than
+// minBits. This is repeated until no such pairs remain, so no addresses are
+// added. The Prefixes must be sorted as by PrefixSet.Prefixes.
+func MergeSiblings(prefixes []netip.Prefix, minBits int) []netip.Prefix {
+	merged := []netip.Prefix{}
+	for _, p := range prefixes {
+		p = p.Masked()
+		for {
+			n := len(merged)
+			if n > 0 && merged[n-1] == p {
+				break
+			}
+			if n == 0 || p.Bits() <= minBits || merged[n-1].Bits() != p.Bits() {
+				merged = append(merged, p)
+				break
+			}
+			parent := netip.PrefixFrom(p.Addr(), p.Bits()-1).Masked()
+			if !parent.Contains(merged[n-1].Addr()) {
+				merged = append(merged, p)
+				break
+			}
+			merged, p = merged[:n-1], parent
+		}
+	}
+	return merged
+}
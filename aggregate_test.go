@@ -0,0 +1,151 @@
+package main
+
+import (
+	"math/big"
+	"math/rand"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestAggregatePrefixes(t *testing.T) {
+	input := []string{
+		"10.0.0.0/24", "10.0.1.0/24", "10.0.3.0/24", "10.1.0.0/16",
+		"192.168.0.0/24", "::1/128",
+	}
+	tests := []struct {
+		maxPrefixes int
+		minBits     int
+		forbid      []string
+		want        []string
+		extra       int64
+	}{
+		{6, 0, nil, input, 0},
+		{5, 0, nil, []string{"10.0.0.0/23", "10.0.3.0/24", "10.1.0.0/16", "192.168.0.0/24", "::1/128"}, 0},
+		{4, 0, nil, []string{"10.0.0.0/22", "10.1.0.0/16", "192.168.0.0/24", "::1/128"}, 256},
+		{3, 0, nil, []string{"10.0.0.0/15", "192.168.0.0/24", "::1/128"}, 64768},
+		{3, 16, nil, nil, -1},
+		{4, 23, nil, nil, -1},
+		{4, 22, nil, []string{"10.0.0.0/22", "10.1.0.0/16", "192.168.0.0/24", "::1/128"}, 256},
+		{4, 0, []string{"10.0.2.0/24"}, nil, -1},
+		{4, 0, []string{"10.0.0.0/24", "192.168.0.0/16"}, []string{"10.0.0.0/22", "10.1.0.0/16", "192.168.0.0/24", "::1/128"}, 256},
+	}
+	for _, tt := range tests {
+		got, extra, err := AggregatePrefixes(mustParsePrefixes(input...),
+			tt.maxPrefixes, tt.minBits, prefixSetOf(mustParsePrefixes(tt.forbid...)...))
+		if tt.extra < 0 {
+			if err == nil {
+				t.Errorf("AggregatePrefixes(%d, forbid %v) = %v, want error",
+					tt.maxPrefixes, tt.forbid, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("AggregatePrefixes(%d, forbid %v): %v", tt.maxPrefixes, tt.forbid, err)
+		}
+		if !slices.Equal(got, mustParsePrefixes(tt.want...)) || extra.Int64() != tt.extra {
+			t.Errorf("AggregatePrefixes(%d, forbid %v) = %v, %s; want %v, %d",
+				tt.maxPrefixes, tt.forbid, got, extra, tt.want, tt.extra)
+		}
+	}
+
+	// Check random inputs address by address
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		prefixes := prefixSetOf(randomPrefixes(rng, 1+rng.Intn(20))...).PrefixesCompact()
+		forbid := randomPrefixes(rng, rng.Intn(3))
+		maxPrefixes := 1 + rng.Intn(len(prefixes))
+		minBits := 24 + rng.Intn(4)
+		got, extra, err := AggregatePrefixes(prefixes, maxPrefixes, minBits,
+			prefixSetOf(forbid...))
+		if err != nil {
+			continue
+		}
+		orig, aggregated, forbidden := addrSet(prefixes...), addrSet(got...), addrSet(forbid...)
+		if len(got) > maxPrefixes {
+			t.Fatalf("%v into %d prefixes: got %v", prefixes, maxPrefixes, got)
+		}
+		if big.NewInt(int64(len(aggregated)-len(orig))).Cmp(extra) != 0 {
+			t.Fatalf("%v into %d prefixes: got %v with %s extra addresses, want %d",
+				prefixes, maxPrefixes, got, extra, len(aggregated)-len(orig))
+		}
+		for a := range orig {
+			if !aggregated[a] {
+				t.Fatalf("%v into %d prefixes: got %v, missing %s", prefixes, maxPrefixes, got, a)
+			}
+		}
+		for a := range aggregated {
+			if forbidden[a] && !orig[a] {
+				t.Fatalf("%v into %d prefixes: got %v, covering forbidden %s",
+					prefixes, maxPrefixes, got, a)
+			}
+		}
+		for _, p := range got {
+			if p.Bits() < minBits && !slices.Contains(prefixes, p) {
+				t.Fatalf("%v into %d prefixes: got %v, shorter than /%d",
+					prefixes, maxPrefixes, got, minBits)
+			}
+		}
+		for j := 1; j < len(got); j++ {
+			if got[j-1].Overlaps(got[j]) || got[j-1].Addr().Compare(got[j].Addr()) > 0 {
+				t.Fatalf("%v into %d prefixes: got unsorted or overlapping %v",
+					prefixes, maxPrefixes, got)
+			}
+		}
+	}
+}
+
+func TestMergeSiblings(t *testing.T) {
+	tests := []struct {
+		prefixes []string
+		minBits  int
+		want     []string
+	}{
+		{[]string{"10.0.0.0/25", "10.0.0.128/25"}, 0, []string{"10.0.0.0/24"}},
+		{[]string{"10.0.0.0/25", "10.0.0.128/25"}, 24, []string{"10.0.0.0/24"}},
+		{[]string{"10.0.0.0/25", "10.0.0.128/25"}, 25, []string{"10.0.0.0/25", "10.0.0.128/25"}},
+		{[]string{"10.0.0.128/25", "10.0.1.0/25"}, 0, []string{"10.0.0.128/25", "10.0.1.0/25"}},
+		{
+			[]string{"10.0.0.0/25", "10.0.0.128/26", "10.0.0.192/26", "10.0.1.0/24"},
+			0,
+			[]string{"10.0.0.0/23"},
+		},
+		{
+			[]string{"10.0.0.0/24", "10.0.0.0/25", "10.0.0.128/25", "10.0.1.0/24"},
+			0,
+			[]string{"10.0.0.0/23"},
+		},
+		{[]string{"0.0.0.0/1", "128.0.0.0/1"}, 0, []string{"0.0.0.0/0"}},
+	}
+	for _, tt := range tests {
+		got := MergeSiblings(mustParsePrefixes(tt.prefixes...), tt.minBits)
+		if !slices.Equal(got, mustParsePrefixes(tt.want...)) {
+			t.Errorf("MergeSiblings(%v, %d) = %v, want %v", tt.prefixes, tt.minBits, got, tt.want)
+		}
+	}
+
+	// Merging must never change the addresses covered, and must leave no
+	// mergeable siblings behind
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		ps := prefixSetOf(randomPrefixes(rng, 1+rng.Intn(20))...)
+		prefixes := ps.Prefixes()
+		if rng.Intn(2) == 0 {
+			prefixes = ps.PrefixesCompact()
+		}
+		minBits := 24 + rng.Intn(4)
+		got := MergeSiblings(prefixes, minBits)
+		want := addrSet(prefixes...)
+		if covered := addrSet(got...); len(covered) != len(want) {
+			t.Fatalf("MergeSiblings(%v, %d) = %v covers %d addresses, want %d",
+				prefixes, minBits, got, len(covered), len(want))
+		}
+		for j := 1; j < len(got); j++ {
+			p, q := got[j-1], got[j]
+			parent := netip.PrefixFrom(p.Addr(), p.Bits()-1).Masked()
+			if p == q || (p.Bits() == q.Bits() && p.Bits() > minBits && parent.Contains(q.Addr())) {
+				t.Fatalf("MergeSiblings(%v, %d) = %v", prefixes, minBits, got)
+			}
+		}
+	}
+}
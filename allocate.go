@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/aromatt/netipds"
+)
+
+// AllocatePrefixes takes count Prefixes of length bits from the free address
+// space in free, removing them from free. Each allocated Prefix starts on a
+// /align boundary (if align is nonzero). With bestFit, each Prefix is taken
+// from the smallest free block that can hold it; otherwise, from the first
+// (lowest) one. Either all count Prefixes are allocated, or an error is
+// returned.
+func AllocatePrefixes(
+	free *netipds.PrefixSetBuilder,
+	bits, align, count int,
+	bestFit bool,
+) ([]netip.Prefix, error) {
+	allocated := []netip.Prefix{}
+	for len(allocated) < count {
+		// Merge siblings so that adjacent free blocks (e.g. two /25s) can
+		// together hold a shorter Prefix (e.g. a /24)
+		var block netip.Prefix
+		for _, p := range MergeSiblings(free.PrefixSet().PrefixesCompact(), 0) {
+			// Skip blocks that are too small, or whose only candidate is
+			// misaligned
+			if p.Bits() > bits || bits > p.Addr().BitLen() {
+				continue
+			}
+			if align > 0 && align < p.Bits() &&
+				netip.PrefixFrom(p.Addr(), align).Masked().Addr() != p.Addr() {
+				continue
+			}
+			if !block.IsValid() {
+				block = p
+				if !bestFit {
+					break
+				}
+			} else if p.Bits() > block.Bits() {
+				block = p
+			}
+		}
+		if !block.IsValid() {
+			return nil, fmt.Errorf("Only %d free /%d blocks available",
+				len(allocated), bits)
+		}
+		p := netip.PrefixFrom(block.Addr(), bits)
+		allocated = append(allocated, p)
+		psb := netipds.PrefixSetBuilder{}
+		psb.Add(p)
+		PrefixSetBuilderSubtract(free, psb.PrefixSet())
+	}
+	return allocated, nil
+}
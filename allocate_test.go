@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math/rand"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/aromatt/netipds"
+)
+
+func TestAllocatePrefixes(t *testing.T) {
+	pool := []string{"10.0.0.0/24", "10.1.0.0/26"}
+	used := []string{"10.0.0.0/26", "10.0.0.128/27"}
+	tests := []struct {
+		bits, align, count int
+		bestFit            bool
+		want               []string
+	}{
+		{27, 0, 3, false, []string{"10.0.0.64/27", "10.0.0.96/27", "10.0.0.160/27"}},
+		{27, 0, 3, true, []string{"10.0.0.160/27", "10.0.0.64/27", "10.0.0.96/27"}},
+		{26, 0, 3, false, []string{"10.0.0.64/26", "10.0.0.192/26", "10.1.0.0/26"}},
+		{27, 25, 1, false, []string{"10.1.0.0/27"}},
+		{27, 25, 2, false, nil},
+		{26, 0, 4, false, nil},
+		{23, 0, 1, false, nil},
+	}
+	for _, tt := range tests {
+		free := netipds.PrefixSetBuilder{}
+		free.Merge(prefixSetOf(mustParsePrefixes(pool...)...))
+		PrefixSetBuilderSubtract(&free, prefixSetOf(mustParsePrefixes(used...)...))
+		got, err := AllocatePrefixes(&free, tt.bits, tt.align, tt.count, tt.bestFit)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("AllocatePrefixes(/%d, align %d, count %d) = %v, want error",
+					tt.bits, tt.align, tt.count, got)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(got, mustParsePrefixes(tt.want...)) {
+			t.Errorf("AllocatePrefixes(/%d, align %d, count %d, best %v) = %v, %v; want %v",
+				tt.bits, tt.align, tt.count, tt.bestFit, got, err, tt.want)
+		}
+	}
+
+	// Adjacent free blocks can hold a longer Prefix together
+	free := netipds.PrefixSetBuilder{}
+	free.Merge(prefixSetOf(mustParsePrefixes("10.0.0.0/25", "10.0.0.128/25")...))
+	got, err := AllocatePrefixes(&free, 24, 0, 1, false)
+	if err != nil || !slices.Equal(got, mustParsePrefixes("10.0.0.0/24")) {
+		t.Errorf("AllocatePrefixes(/24) from two /25s = %v, %v; want [10.0.0.0/24]", got, err)
+	}
+
+	// Allocated Prefixes must be free, aligned and disjoint, and must be
+	// removed from the free space. Allocation may only fail if there are
+	// fewer free, aligned blocks than requested.
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		pool := randomPrefixes(rng, 1+rng.Intn(4))
+		used := randomPrefixes(rng, rng.Intn(6))
+		bits := 26 + rng.Intn(7)
+		align := 0
+		if rng.Intn(2) == 0 {
+			align = 24 + rng.Intn(bits-23)
+		}
+		free := netipds.PrefixSetBuilder{}
+		free.Merge(prefixSetOf(pool...))
+		PrefixSetBuilderSubtract(&free, prefixSetOf(used...))
+		available := addrSet(free.PrefixSet().PrefixesCompact()...)
+
+		count := 1 + rng.Intn(4)
+		got, err := AllocatePrefixes(&free, bits, align, count, rng.Intn(2) == 0)
+		if err != nil {
+			blocks := 0
+			EachSubnet(netip.MustParsePrefix("10.0.0.0/24"), bits, func(p netip.Prefix) {
+				if align > 0 && netip.PrefixFrom(p.Addr(), align).Masked().Addr() != p.Addr() {
+					return
+				}
+				for a := range addrSet(p) {
+					if !available[a] {
+						return
+					}
+				}
+				blocks++
+			})
+			if blocks >= count {
+				t.Fatalf("pool %v, used %v: allocating %d /%d failed with %d free blocks",
+					pool, used, count, bits, blocks)
+			}
+			continue
+		}
+		allocated := map[netip.Addr]bool{}
+		for _, p := range got {
+			if p.Bits() != bits || p.Masked() != p {
+				t.Fatalf("allocated %s, want a /%d", p, bits)
+			}
+			if align > 0 && netip.PrefixFrom(p.Addr(), align).Masked().Addr() != p.Addr() {
+				t.Fatalf("allocated %s, want /%d alignment", p, align)
+			}
+			for a := range addrSet(p) {
+				if !available[a] || allocated[a] {
+					t.Fatalf("pool %v, used %v: allocated %v, %s is not free", pool, used, got, a)
+				}
+				allocated[a] = true
+			}
+		}
+		remaining := addrSet(free.PrefixSet().PrefixesCompact()...)
+		if len(remaining) != len(available)-len(allocated) {
+			t.Fatalf("pool %v, used %v: %d addresses remain free, want %d",
+				pool, used, len(remaining), len(available)-len(allocated))
+		}
+	}
+}
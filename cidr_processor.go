@@ -2,18 +2,24 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net/netip"
+	"slices"
 	"strings"
 )
 
+// ErrStopProcessing may be returned by a HandlerFn to make Process stop
+// reading input and return without an error.
+var ErrStopProcessing = errors.New("stop processing")
+
 // CidrProcessor consolidates all of the configuration provided by a user for
 // processing lists of CIDRs.
 type CidrProcessor struct {
 	Fields    []int
 	Delimiter string
-	ValParser func(string) (netip.Prefix, error)
+	ValParser func(string) ([]netip.Prefix, error)
 	HandlerFn func(*ParsedLine) error
 	ErrFn     func(string, error) error
 }
@@ -22,91 +28,153 @@ type CidrProcessor struct {
 func LineParser(
 	fields []int,
 	delimiter string,
-	valParser func(string) (netip.Prefix, error),
+	valParser func(string) ([]netip.Prefix, error),
 ) func(string) ([]netip.Prefix, error) {
 	if len(fields) != 0 {
-		if delimiter == "\\t" {
-			delimiter = "\t"
-		}
+		delimiter = UnescapeDelimiter(delimiter)
 		return func(line string) ([]netip.Prefix, error) {
 			// Split line into fields
 			parts := strings.Split(line, delimiter)
 			prefixes := []netip.Prefix{}
-			var prefix netip.Prefix
-			var err error
 			for _, f := range fields {
 				if f > len(parts) {
 					return prefixes, fmt.Errorf("Field %d not found in line: %s", f, line)
 				}
-				prefix, err = valParser(parts[f-1])
+				fieldPrefixes, err := valParser(parts[f-1])
 				if err != nil {
 					return prefixes, err
 				}
-				prefixes = append(prefixes, prefix)
+				prefixes = append(prefixes, fieldPrefixes...)
 			}
 			return prefixes, nil
 		}
 	}
-	return ToSliceOfOneFn(valParser)
+	return valParser
 }
 
 type ParsedLine struct {
-	Raw       string
-	parts     []string
-	Prefixes  []netip.Prefix
-	fields    []bool
+	Raw      string
+	parts    []string
+	Prefixes []netip.Prefix
+	// fields holds the index in parts from which each of Prefixes was parsed.
+	// A single field may yield several consecutive Prefixes (e.g. a range).
+	fields    []int
 	delimiter string
 }
 
 // Clean returns the raw line with any parsed fields replaced by their
-// extracted Prefixes.
+// extracted Prefixes. A field which yielded several Prefixes (a range) is
+// replaced by the range it covers instead, so that no separator is introduced
+// which could be mistaken for the delimiter.
 func (p *ParsedLine) Clean() string {
+	return p.clean(func(prefixes []netip.Prefix) string {
+		if len(prefixes) == 1 {
+			return StringMaybeAddr(prefixes[0])
+		}
+		return StringRanges(prefixes)
+	})
+}
+
+// CleanRanges is like Clean, but replaces parsed fields with the ranges of
+// addresses covered by their extracted Prefixes.
+func (p *ParsedLine) CleanRanges() string {
+	return p.clean(StringRanges)
+}
+
+// clean returns the raw line with each parsed field replaced by fmtFn applied
+// to the Prefixes extracted from that field.
+func (p *ParsedLine) clean(fmtFn func([]netip.Prefix) string) string {
 	if p.delimiter == "" {
-		return StringMaybeAddr(p.Prefixes[0])
+		return fmtFn(p.Prefixes)
 	}
-	b := strings.Builder{}
-	for i, part := range p.parts {
-		if p.fields[i] {
-			b.WriteString(StringMaybeAddr(p.Prefixes[i]))
-		} else {
-			b.WriteString(part)
+	cleaned := slices.Clone(p.parts)
+	for start := 0; start < len(p.fields); {
+		end := start + 1
+		for end < len(p.fields) && p.fields[end] == p.fields[start] {
+			end++
+		}
+		cleaned[p.fields[start]] = fmtFn(p.Prefixes[start:end])
+		start = end
+	}
+	return strings.Join(cleaned, p.delimiter)
+}
+
+// Field returns the (1-based) number of the field from which the i-th Prefix
+// was parsed, or 0 if the line was not split into fields.
+func (p *ParsedLine) Field(i int) int {
+	if p.delimiter == "" {
+		return 0
+	}
+	return p.fields[i] + 1
+}
+
+// Text returns the original text from which the i-th Prefix was parsed.
+func (p *ParsedLine) Text(i int) string {
+	if p.delimiter == "" {
+		return p.Raw
+	}
+	return p.parts[p.fields[i]]
+}
+
+// ParsedField is the text of one field of a ParsedLine and the Prefixes parsed
+// from it. A field holding a range yields several Prefixes, which should be
+// treated as a unit.
+type ParsedField struct {
+	// Field is the (1-based) field number, or 0 if the line was not split
+	// into fields.
+	Field    int
+	Text     string
+	Prefixes []netip.Prefix
+}
+
+// ParsedFields groups the line's Prefixes by the field from which they were
+// parsed. A line which was not split into fields is a single field.
+func (p *ParsedLine) ParsedFields() []ParsedField {
+	parsedFields := []ParsedField{}
+	for start := 0; start < len(p.Prefixes); {
+		end := start + 1
+		for p.delimiter != "" && end < len(p.fields) && p.fields[end] == p.fields[start] {
+			end++
 		}
-		if i < len(p.parts)-1 {
-			b.WriteString(p.delimiter)
+		if p.delimiter == "" {
+			end = len(p.Prefixes)
 		}
+		parsedFields = append(parsedFields, ParsedField{
+			Field:    p.Field(start),
+			Text:     p.Text(start),
+			Prefixes: p.Prefixes[start:end],
+		})
+		start = end
 	}
-	return b.String()
+	return parsedFields
 }
 
 func (p *CidrProcessor) parseLine(line string) (*ParsedLine, error) {
 	parsed := ParsedLine{Raw: line}
 	if len(p.Fields) > 0 {
-		if p.Delimiter == "\\t" {
-			p.Delimiter = "\t"
-		}
+		p.Delimiter = UnescapeDelimiter(p.Delimiter)
 		parsed.delimiter = p.Delimiter
 		parsed.parts = strings.Split(line, p.Delimiter)
-		parsed.fields = make([]bool, len(parsed.parts))
-		var prefix netip.Prefix
-		var err error
 		for _, f := range p.Fields {
 			if f > len(parsed.parts) {
 				return nil, fmt.Errorf("Field %d not found in line: %s", f, line)
 			}
-			prefix, err = p.ValParser(parsed.parts[f-1])
+			prefixes, err := p.ValParser(parsed.parts[f-1])
 			if err != nil {
 				return nil, err
 			}
-			parsed.Prefixes = append(parsed.Prefixes, prefix)
-			parsed.fields[f-1] = true
+			for _, prefix := range prefixes {
+				parsed.Prefixes = append(parsed.Prefixes, prefix)
+				parsed.fields = append(parsed.fields, f-1)
+			}
 		}
 		return &parsed, nil
 	} else {
-		prefix, err := p.ValParser(line)
+		prefixes, err := p.ValParser(line)
 		if err != nil {
 			return nil, err
 		}
-		parsed.Prefixes = append(parsed.Prefixes, prefix)
+		parsed.Prefixes = prefixes
 		return &parsed, nil
 	}
 }
@@ -130,7 +198,9 @@ func (p *CidrProcessor) Process(r io.Reader) error {
 				return err
 			}
 		} else {
-			if err = p.HandlerFn(parsedLine); err != nil {
+			if err = p.HandlerFn(parsedLine); errors.Is(err, ErrStopProcessing) {
+				break
+			} else if err != nil {
 				if err = p.ErrFn(line, err); err != nil {
 					return err
 				}
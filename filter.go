@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aromatt/netipds"
+	"github.com/urfave/cli/v2"
+)
+
+// addrClasses maps the address property classes accepted by --is to the
+// corresponding netip.Addr methods. Unlike netip.Addr.IsGlobalUnicast, the
+// global class excludes private (RFC 1918 and ULA) addresses.
+var addrClasses = map[string]func(netip.Addr) bool{
+	"private": netip.Addr.IsPrivate,
+	"global": func(a netip.Addr) bool {
+		return a.IsGlobalUnicast() && !a.IsPrivate()
+	},
+	"loopback":    netip.Addr.IsLoopback,
+	"multicast":   netip.Addr.IsMulticast,
+	"unspecified": netip.Addr.IsUnspecified,
+	"linklocal": func(a netip.Addr) bool {
+		return a.IsLinkLocalUnicast() || a.IsLinkLocalMulticast()
+	},
+}
+
+// nonGlobalPrefixes holds the blocks of addresses which are not in the global
+// class. Since the global class is not contiguous, a prefix whose first and
+// last addresses are global may still contain one of these blocks.
+var nonGlobalPrefixes = func() *netipds.PrefixSet {
+	psb := netipds.PrefixSetBuilder{}
+	for _, s := range []string{
+		"0.0.0.0/32", "10.0.0.0/8", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.168.0.0/16", "224.0.0.0/4", "255.255.255.255/32",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+	} {
+		psb.Add(netip.MustParsePrefix(s))
+	}
+	return psb.PrefixSet()
+}()
+
+// propertyFn returns a function which returns true if a prefix has the
+// properties requested via --ipv4, --ipv6, --min-bits, --max-bits and --is. A
+// prefix belongs to a class if both its first and last addresses do, and for
+// the global class, if it also contains no non-global addresses.
+func propertyFn(c *cli.Context) func(netip.Prefix) bool {
+	ipv4, ipv6 := c.Bool("ipv4"), c.Bool("ipv6")
+	minBits, maxBits := c.Int("min-bits"), c.Int("max-bits")
+	checkMin, checkMax := c.IsSet("min-bits"), c.IsSet("max-bits")
+	classes := c.StringSlice("is")
+	return func(p netip.Prefix) bool {
+		if ipv4 != ipv6 && p.Addr().Is4() != ipv4 {
+			return false
+		}
+		if (checkMin && p.Bits() < minBits) || (checkMax && p.Bits() > maxBits) {
+			return false
+		}
+		if len(classes) == 0 {
+			return true
+		}
+		first, last := p.Masked().Addr(), LastAddr(p)
+		for _, class := range classes {
+			if class == "global" && nonGlobalPrefixes.OverlapsPrefix(p) {
+				continue
+			}
+			if isClass := addrClasses[class]; isClass(first) && isClass(last) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// prefixFilter decides whether an input prefix passes a set of match and
+// exclude lists, as well as any address property requirements.
+type prefixFilter struct {
+	// MatchSets are the match lists with ExcludeSet subtracted, except in
+	// exact and contains modes, which compare against the list entries as
+	// loaded.
+	MatchSets []*netipds.PrefixSet
+	// LoadedMatchSets are the match lists as loaded, for use by Explain.
+	LoadedMatchSets []*netipds.PrefixSet
+	ExcludeSet      *netipds.PrefixSet
+	MatchFn         func(*netipds.PrefixSet, []netip.Prefix) bool
+	ExcludeFn       func(*netipds.PrefixSet, []netip.Prefix) bool
+	PropertyFn      func(netip.Prefix) bool
+}
+
+// Passes returns true if the Prefixes of an input field (several, if the field
+// is a range) have the required properties, match every match set and are not
+// excluded.
+func (f *prefixFilter) Passes(prefixes []netip.Prefix) bool {
+	for _, p := range prefixes {
+		if f.PropertyFn != nil && !f.PropertyFn(p) {
+			return false
+		}
+	}
+	for _, matchSet := range f.MatchSets {
+		if !f.MatchFn(matchSet, prefixes) {
+			return false
+		}
+	}
+	if f.ExcludeSet != nil && f.ExcludeFn(f.ExcludeSet, prefixes) {
+		return false
+	}
+	return true
+}
+
+// Explain returns the list entries responsible for the decision on the
+// Prefixes of an input field, in the form "match=ENTRY\texclude=ENTRY". Each
+// entry is the longest-prefix match of a Prefix in the loaded list, or if it
+// has no ancestor in the list, the first entry contained by the Prefix. For a
+// range, the first of its Prefixes with such an entry is used. Entries are "-"
+// if there is no such entry or no such list. If there are several match lists,
+// their entries are separated by commas.
+func (f *prefixFilter) Explain(prefixes []netip.Prefix) string {
+	entryString := func(ps *netipds.PrefixSet) string {
+		for _, p := range prefixes {
+			if entry, ok := PrefixSetEntryFor(ps, p); ok {
+				return StringMaybeAddr(entry)
+			}
+		}
+		return "-"
+	}
+	matchEntries := []string{}
+	for _, matchSet := range f.LoadedMatchSets {
+		matchEntries = append(matchEntries, entryString(matchSet))
+	}
+	if len(matchEntries) == 0 {
+		matchEntries = append(matchEntries, "-")
+	}
+	excludeEntry := "-"
+	if f.ExcludeSet != nil {
+		excludeEntry = entryString(f.ExcludeSet)
+	}
+	return fmt.Sprintf(
+		"match=%s\texclude=%s",
+		strings.Join(matchEntries, ","),
+		excludeEntry,
+	)
+}
+
+// filterLists holds the prefixFilter for each input field that was given its
+// own lists (e.g. --match 3=FILE), as well as the default prefixFilter for all
+// other fields.
+type filterLists struct {
+	Default *prefixFilter
+	ByField map[int]*prefixFilter
+}
+
+// For returns the prefixFilter for the provided field, and whether the field
+// has its own lists.
+func (fl *filterLists) For(field int) (*prefixFilter, bool) {
+	if f, ok := fl.ByField[field]; ok {
+		return f, true
+	}
+	return fl.Default, false
+}
+
+// Fields returns the sorted field numbers which have their own lists.
+func (fl *filterLists) Fields() []int {
+	fields := make([]int, 0, len(fl.ByField))
+	for field := range fl.ByField {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+	return fields
+}
+
+// parseListArg splits a list argument of the form "N=LIST" into the field
+// number N and LIST. If arg does not specify a field, the returned field is 0.
+func parseListArg(arg string) (field int, list string) {
+	if before, after, found := strings.Cut(arg, "="); found {
+		if n, err := strconv.Atoi(before); err == nil && n > 0 {
+			return n, after
+		}
+	}
+	return 0, arg
+}
+
+// loadFilterLists loads the match and exclude lists provided to the filter
+// command. Unless --match-all is set, the match lists for each field are
+// combined into one set. A field's own match lists replace the default match
+// lists, while its own exclude lists are combined with the default exclude
+// lists. Excluded CIDRs are subtracted from the match sets, unless the match
+// mode is exact or contains: subtraction splits list entries into fragments,
+// which those modes would treat as entries.
+func loadFilterLists(c *cli.Context) (*filterLists, error) {
+	matchAll := c.Bool("match-all")
+	matchMode := c.String("match-mode")
+	subtractExcluded := matchMode != "exact" && matchMode != "contains"
+	matchFn := prefixSetMembershipFn(matchMode)
+	excludeFn := prefixSetMembershipFn(c.String("exclude-mode"))
+
+	// Load lists, keyed by field (0 for the default lists)
+	excludePsbs := map[int]*netipds.PrefixSetBuilder{}
+	matchPsbs := map[int][]*netipds.PrefixSetBuilder{}
+	addMatchList := func(field int, matchPsb *netipds.PrefixSetBuilder) {
+		if matchAll || len(matchPsbs[field]) == 0 {
+			matchPsbs[field] = append(matchPsbs[field], matchPsb)
+		} else {
+			matchPsbs[field][0].Merge(matchPsb.PrefixSet())
+		}
+	}
+
+	// --exclude, --exclude-cidr
+	if excludeCidrs := c.StringSlice("exclude-cidr"); len(excludeCidrs) > 0 {
+		excludePsb, err := PrefixSetBuilderFromStrings(excludeCidrs)
+		if err != nil {
+			return nil, err
+		}
+		excludePsbs[0] = excludePsb
+	}
+	for _, excludeArg := range c.StringSlice("exclude") {
+		field, list := parseListArg(excludeArg)
+		Logf("Loading exclude list '%s'\n", excludeArg)
+		ps, err := LoadPrefixSet(list, errorHandler)
+		if err != nil {
+			return nil, err
+		}
+		if excludePsbs[field] == nil {
+			excludePsbs[field] = &netipds.PrefixSetBuilder{}
+		}
+		excludePsbs[field].Merge(ps)
+	}
+
+	// --match, --match-cidr
+	if matchCidrs := c.StringSlice("match-cidr"); len(matchCidrs) > 0 {
+		matchPsb, err := PrefixSetBuilderFromStrings(matchCidrs)
+		if err != nil {
+			return nil, err
+		}
+		addMatchList(0, matchPsb)
+	}
+	for _, matchArg := range c.StringSlice("match") {
+		field, list := parseListArg(matchArg)
+		Logf("Loading match list '%s'\n", matchArg)
+		matchPsb, err := LoadPrefixSetBuilder(list, errorHandler)
+		if err != nil {
+			return nil, err
+		}
+		addMatchList(field, matchPsb)
+	}
+
+	// Build a prefixFilter for each field
+	fields := map[int]bool{0: true}
+	for field := range excludePsbs {
+		fields[field] = true
+	}
+	for field := range matchPsbs {
+		fields[field] = true
+	}
+	fl := filterLists{ByField: map[int]*prefixFilter{}}
+	for field := range fields {
+		f := prefixFilter{
+			MatchFn:    matchFn,
+			ExcludeFn:  excludeFn,
+			PropertyFn: propertyFn(c),
+		}
+
+		if excludePsbs[0] != nil || excludePsbs[field] != nil {
+			excludePsb := netipds.PrefixSetBuilder{}
+			if excludePsbs[0] != nil {
+				excludePsb.Merge(excludePsbs[0].PrefixSet())
+			}
+			if excludePsbs[field] != nil {
+				excludePsb.Merge(excludePsbs[field].PrefixSet())
+			}
+			f.ExcludeSet = excludePsb.PrefixSet()
+		}
+
+		fieldMatchPsbs, ok := matchPsbs[field]
+		if !ok {
+			fieldMatchPsbs = matchPsbs[0]
+		}
+		for _, matchPsb := range fieldMatchPsbs {
+			ps := matchPsb.PrefixSet()
+			f.LoadedMatchSets = append(f.LoadedMatchSets, ps)
+			if f.ExcludeSet != nil && subtractExcluded {
+				psb := netipds.PrefixSetBuilder{}
+				psb.Merge(ps)
+				PrefixSetBuilderSubtract(&psb, f.ExcludeSet)
+				ps = psb.PrefixSet()
+			}
+			f.MatchSets = append(f.MatchSets, ps)
+		}
+
+		if field == 0 {
+			fl.Default = &f
+		} else {
+			fl.ByField[field] = &f
+		}
+	}
+	return &fl, nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// LockFile is a no-op on platforms without flock, so concurrent writers are
+// not serialized there.
+func LockFile(path string) (func() error, error) {
+	return func() error { return nil }, nil
+}
@@ -0,0 +1,24 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// LockFile takes an exclusive lock on the file at path, creating the file if
+// it does not exist, and blocks until the lock is acquired. The returned
+// function releases the lock.
+func LockFile(path string) (func() error, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	// Closing the file releases the lock
+	return f.Close, nil
+}
@@ -1,10 +1,20 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"math/big"
+	"math/rand"
 	"net/netip"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aromatt/netipds"
 	"github.com/urfave/cli/v2"
@@ -22,6 +32,10 @@ const (
 
 var errorHandler func(string, error) error
 
+// errNoMatch is returned by commands that found no matching input. It causes
+// cidrq to exit with status 1 rather than 2, which indicates an error.
+var errNoMatch = errors.New("no match")
+
 func setErrorHandler(c *cli.Context) error {
 	v := c.String("err")
 	switch v {
@@ -61,7 +75,7 @@ type CombineOp struct {
 }
 
 var Subtract CombineOpFn = func(a *netipds.PrefixSetBuilder, b *netipds.PrefixSet) {
-	a.Subtract(b)
+	PrefixSetBuilderSubtract(a, b)
 }
 
 var Intersect CombineOpFn = func(a *netipds.PrefixSetBuilder, b *netipds.PrefixSet) {
@@ -83,15 +97,96 @@ func validatePath(c *cli.Context, v string) error {
 	return nil
 }
 
-func validateExcludeMode(c *cli.Context, v string) error {
+// isValidMembershipMode returns true if v is a mode accepted by
+// prefixSetMembershipFn.
+func isValidMembershipMode(v string) bool {
+	if _, ok := parseCoverageMode(v); ok {
+		return true
+	}
+	switch v {
+	case "overlap", "encompass", "cover", "exact", "contains":
+		return true
+	}
+	return false
+}
+
+// validateListArgs validates arguments that name CIDR lists, which may be
+// either paths to files or built-in named sets (e.g. @rfc1918), optionally
+// prefixed with a field number (e.g. 3=FILE).
+func validateListArgs(c *cli.Context, v []string) error {
+	for _, arg := range v {
+		_, arg = parseListArg(arg)
+		if name, found := strings.CutPrefix(arg, "@"); found {
+			if _, ok := namedSets[name]; !ok {
+				return fmt.Errorf("Unknown named set '%s'", arg)
+			}
+		} else if err := validatePath(c, arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateAggregateBits(c *cli.Context, v int) error {
+	if v < 0 || v > 128 {
+		return fmt.Errorf("Invalid prefix length: %d", v)
+	}
+	return nil
+}
+
+func validateAllocateStrategy(c *cli.Context, v string) error {
+	if !(v == "first" || v == "best") {
+		return fmt.Errorf("Invalid strategy: '%s'", v)
+	}
+	return nil
+}
+
+func validateRequire(c *cli.Context, v string) error {
+	if !(v == "any" || v == "all") {
+		return fmt.Errorf("Invalid require value: '%s'", v)
+	}
+	return nil
+}
+
+func validateClasses(c *cli.Context, v []string) error {
+	for _, class := range v {
+		if _, ok := addrClasses[class]; !ok {
+			return fmt.Errorf("Invalid address class: '%s'", class)
+		}
+	}
+	return nil
+}
+
+func validateJoinMode(c *cli.Context, v string) error {
+	if !(v == "contains" || v == "overlap" || v == "equal") {
+		return fmt.Errorf("Invalid join mode: '%s'", v)
+	}
+	return nil
+}
+
+func validateJoinType(c *cli.Context, v string) error {
+	if !(v == "inner" || v == "left" || v == "anti") {
+		return fmt.Errorf("Invalid join type: '%s'", v)
+	}
+	return nil
+}
+
+func validateWhichMode(c *cli.Context, v string) error {
 	if !(v == "overlap" || v == "encompass") {
+		return fmt.Errorf("Invalid mode: '%s'", v)
+	}
+	return nil
+}
+
+func validateExcludeMode(c *cli.Context, v string) error {
+	if !isValidMembershipMode(v) {
 		return fmt.Errorf("Invalid exclude mode: '%s'", v)
 	}
 	return nil
 }
 
 func validateMatchMode(c *cli.Context, v string) error {
-	if !(v == "overlap" || v == "encompass") {
+	if !isValidMembershipMode(v) {
 		return fmt.Errorf("Invalid match mode: '%s'", v)
 	}
 	return nil
@@ -130,23 +225,60 @@ func iterPathArgs(c *cli.Context, fn func(io.Reader) error) error {
 	return nil
 }
 
+// parseCoverageMode parses a mode of the form "coverage:FRACTION" and returns
+// the fraction, which must be in the range (0, 1].
+func parseCoverageMode(mode string) (float64, bool) {
+	v, found := strings.CutPrefix(mode, "coverage:")
+	if !found {
+		return 0, false
+	}
+	threshold, err := strconv.ParseFloat(v, 64)
+	if err != nil || !(threshold > 0 && threshold <= 1) {
+		return 0, false
+	}
+	return threshold, true
+}
+
 // prefixSetMembershipFn returns a function which calls the method of PrefixSet
-// corresponding to the provided mode.
-func prefixSetMembershipFn(mode string) func(*netipds.PrefixSet, netip.Prefix) bool {
+// corresponding to the provided mode. The function is passed the Prefixes of
+// one input field, which are checked as a unit: in overlap and contains modes
+// any of them may match, in coverage mode their union is measured, and in the
+// other modes every one of them must match.
+func prefixSetMembershipFn(mode string) func(*netipds.PrefixSet, []netip.Prefix) bool {
+	if threshold, ok := parseCoverageMode(mode); ok {
+		return func(ps *netipds.PrefixSet, prefixes []netip.Prefix) bool {
+			return PrefixSetCoverage(ps, prefixes...) >= threshold
+		}
+	}
+	var fn func(*netipds.PrefixSet, netip.Prefix) bool
+	anyPrefix := false
 	switch mode {
 	case "overlap":
-		return func(ps *netipds.PrefixSet, p netip.Prefix) bool {
-			return ps.OverlapsPrefix(p)
-		}
+		fn, anyPrefix = (*netipds.PrefixSet).OverlapsPrefix, true
 	case "encompass":
-		return func(ps *netipds.PrefixSet, p netip.Prefix) bool {
-			return ps.Encompasses(p)
+		fn = (*netipds.PrefixSet).Encompasses
+	case "cover":
+		fn = PrefixSetCovers
+	case "exact":
+		fn = func(ps *netipds.PrefixSet, p netip.Prefix) bool {
+			return ps.Contains(p.Masked())
 		}
-	// TODO add "cover" mode - returns true if the prefix can be covered by any
-	// subset of prefixes in the set. Do this once PrefixSet has a Covers method.
+	case "contains":
+		fn = func(ps *netipds.PrefixSet, p netip.Prefix) bool {
+			return ps.DescendantsOf(p.Masked()).Size() > 0
+		}
+		anyPrefix = true
 	default:
 		panic("Invalid mode")
 	}
+	return func(ps *netipds.PrefixSet, prefixes []netip.Prefix) bool {
+		for _, p := range prefixes {
+			if fn(ps, p) == anyPrefix {
+				return anyPrefix
+			}
+		}
+		return !anyPrefix
+	}
 }
 
 // PrefixSetBuilderCidrProcessor creates a CidrProcessor which uses
@@ -168,6 +300,48 @@ func PrefixSetBuilderCidrProcessor() (*CidrProcessor, *netipds.PrefixSetBuilder)
 	return &cp, &psb
 }
 
+// splitLimitFn returns a function which counts the CIDRs that splitting a
+// prefix into its subnets of length bits would produce, and returns an error
+// if the running total would exceed --max-split.
+func splitLimitFn(c *cli.Context) func(p netip.Prefix, bits int) error {
+	maxSplit := big.NewInt(c.Int64("max-split"))
+	total := big.NewInt(0)
+	return func(p netip.Prefix, bits int) error {
+		bits = min(bits, p.Addr().BitLen())
+		if bits <= p.Bits() {
+			return nil
+		}
+		n := new(big.Int).Lsh(big.NewInt(1), uint(bits-p.Bits()))
+		total.Add(total, n)
+		if maxSplit.Sign() > 0 && total.Cmp(maxSplit) > 0 {
+			total.Sub(total, n)
+			return fmt.Errorf(
+				"Splitting %s into /%d subnets would exceed --max-split %s subnets",
+				StringMaybeAddr(p), bits, maxSplit)
+		}
+		return nil
+	}
+}
+
+// boundPrefixes splits sorted prefixes down to --max-aggregate-bits and then
+// merges siblings up to --min-aggregate-bits.
+func boundPrefixes(c *cli.Context, prefixes []netip.Prefix) ([]netip.Prefix, error) {
+	maxBits := c.Int("max-aggregate-bits")
+	if maxBits > 0 {
+		checkSplit := splitLimitFn(c)
+		for _, p := range prefixes {
+			if err := checkSplit(p, maxBits); err != nil {
+				return nil, err
+			}
+		}
+		prefixes = SplitPrefixesTo(prefixes, maxBits)
+	}
+	if minBits := c.Int("min-aggregate-bits"); minBits > 0 {
+		prefixes = MergeSiblings(prefixes, max(minBits, maxBits))
+	}
+	return prefixes, nil
+}
+
 // Subcommand handlers
 
 func handleCombine(c *cli.Context) error {
@@ -193,104 +367,881 @@ func handleCombine(c *cli.Context) error {
 	}
 
 	// Output combined CIDR set
-	combinedPs := workingPsb.PrefixSet()
-	for _, p := range combinedPs.PrefixesCompact() {
+	combined, err := boundPrefixes(c, workingPsb.PrefixSet().PrefixesCompact())
+	if err != nil {
+		return err
+	}
+	if maxPrefixes := c.Int("max-prefixes"); maxPrefixes > 0 {
+		forbid := &netipds.PrefixSet{}
+		if c.IsSet("forbid") {
+			if forbid, err = LoadPrefixSet(c.String("forbid"), errorHandler); err != nil {
+				return err
+			}
+		}
+		var extra *big.Int
+		combined, extra, err = AggregatePrefixes(
+			combined, maxPrefixes, c.Int("max-aggregate-bits"), forbid)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Aggregation added %s extra addresses\n", extra)
+	} else if c.IsSet("forbid") {
+		return fmt.Errorf("--forbid requires --max-prefixes")
+	}
+	if c.Bool("ranges") {
+		for _, r := range PrefixRanges(combined) {
+			fmt.Println(r)
+		}
+		return nil
+	}
+	for _, p := range combined {
 		fmt.Println(StringMaybeAddr(p))
 	}
 	return nil
 }
 
-func handleFilter(c *cli.Context) error {
-	var err error
-	var excludeSet, matchSet *netipds.PrefixSet
+func handleFilter(c *cli.Context) error {
+	quiet := c.Bool("quiet")
+	clean := c.Bool("clean")
+	flat := c.Bool("flat")
+	ranges := c.Bool("ranges")
+	invert := c.Bool("invert")
+	requireAll := c.String("require") == "all"
+	count := c.Bool("count") && !quiet
+	maxCount := c.Int("max-count")
+	explain := c.Bool("explain")
+
+	lists, err := loadFilterLists(c)
+	if err != nil {
+		return err
+	}
+
+	// Fields with their own lists are parsed even if not selected via --field.
+	fields := c.IntSlice("field")
+	for _, field := range lists.Fields() {
+		if !slices.Contains(fields, field) {
+			fields = append(fields, field)
+		}
+	}
+
+	// linePasses returns whether each of the line's fields passes, and whether
+	// the line as a whole passes. A field holding a range passes or fails as a
+	// unit. A line passes if every field with its own lists passes, and any
+	// (or, with --require all, every) other field passes. In invert mode, a
+	// line or field passes if it would otherwise have been dropped.
+	linePasses := func(parsedFields []ParsedField) ([]bool, bool) {
+		allFieldsPassed := true
+		anyOther, anyOtherPassed, allOtherPassed := false, false, true
+		passed := make([]bool, len(parsedFields))
+		for i, pf := range parsedFields {
+			f, hasOwnLists := lists.For(pf.Field)
+			passed[i] = f.Passes(pf.Prefixes)
+			if hasOwnLists {
+				allFieldsPassed = allFieldsPassed && passed[i]
+			} else {
+				anyOther = true
+				anyOtherPassed = anyOtherPassed || passed[i]
+				allOtherPassed = allOtherPassed && passed[i]
+			}
+		}
+		linePassed := allFieldsPassed
+		if anyOther && requireAll {
+			linePassed = linePassed && allOtherPassed
+		} else if anyOther {
+			linePassed = linePassed && anyOtherPassed
+		}
+		if invert {
+			for i := range passed {
+				passed[i] = !passed[i]
+			}
+			linePassed = !linePassed
+		}
+		return passed, linePassed
+	}
+
+	// printLine prints a line that passed, or its passing fields in flat
+	// mode.
+	printLine := func(parsed *ParsedLine, parsedFields []ParsedField, passed []bool) {
+		if flat {
+			for i, pf := range parsedFields {
+				if !passed[i] {
+					continue
+				}
+				if clean && ranges {
+					fmt.Println(StringRanges(pf.Prefixes))
+				} else if clean {
+					for _, p := range pf.Prefixes {
+						fmt.Println(StringMaybeAddr(p))
+					}
+				} else {
+					fmt.Println(pf.Text)
+				}
+			}
+		} else if clean && ranges {
+			fmt.Println(parsed.CleanRanges())
+		} else if clean {
+			fmt.Println(parsed.Clean())
+		} else {
+			fmt.Println(parsed.Raw)
+		}
+	}
+
+	// Set up processor
+	matched := 0
+	pr := CidrProcessor{
+		Fields:    fields,
+		Delimiter: c.String("delimiter"),
+		ValParser: ValParser(c.Bool("url"), c.Bool("host")),
+		ErrFn:     errorHandler,
+		HandlerFn: func(parsed *ParsedLine) error {
+			parsedFields := parsed.ParsedFields()
+			passed, linePassed := linePasses(parsedFields)
+			if explain {
+				// A field passes if its line does (and, in flat mode, if the
+				// field itself does)
+				for i, pf := range parsedFields {
+					f, _ := lists.For(pf.Field)
+					verdict := "drop"
+					if linePassed && (!flat || passed[i]) {
+						verdict = "pass"
+					}
+					fmt.Fprintf(os.Stderr, "%s\t%s\t%s\n",
+						pf.Text, verdict, f.Explain(pf.Prefixes))
+				}
+			}
+			if !linePassed {
+				return nil
+			}
+			if !count && !quiet {
+				printLine(parsed, parsedFields, passed)
+			}
+			matched++
+			// In quiet mode, like grep -q, stop at the first match
+			if quiet || (maxCount > 0 && matched >= maxCount) {
+				return ErrStopProcessing
+			}
+			return nil
+		},
+	}
+
+	Logf("Processing input CIDRs\n")
+	err = iterPathArgs(c, func(r io.Reader) error {
+		if (quiet && matched > 0) || (maxCount > 0 && matched >= maxCount) {
+			return nil
+		}
+		return pr.Process(r)
+	})
+	if err != nil {
+		return err
+	}
+
+	if count {
+		fmt.Println(matched)
+	}
+	if matched == 0 {
+		return errNoMatch
+	}
+	return nil
+}
+
+func handleLookup(c *cli.Context) error {
+	delimiter := UnescapeDelimiter(c.String("delimiter"))
+	defaultLabel := c.String("default")
+	clean := c.Bool("clean")
+
+	Logf("Loading table '%s'\n", c.String("table"))
+	table, err := LoadPrefixMapFromFile(c.String("table"), delimiter, errorHandler)
+	if err != nil {
+		return err
+	}
+
+	// Set up processor
+	pr := CidrProcessor{
+		Fields:    c.IntSlice("field"),
+		Delimiter: delimiter,
+		ValParser: ValParser(c.Bool("url"), c.Bool("host")),
+		ErrFn:     errorHandler,
+		HandlerFn: func(parsed *ParsedLine) error {
+			b := strings.Builder{}
+			if clean {
+				b.WriteString(parsed.Clean())
+			} else {
+				b.WriteString(parsed.Raw)
+			}
+			// Append the label of the longest-prefix match of each field. For
+			// a range, this is the longest table CIDR containing all of it.
+			for _, pf := range parsed.ParsedFields() {
+				first, last := pf.Prefixes[0], pf.Prefixes[len(pf.Prefixes)-1]
+				p := commonSupernet(first.Masked(), last.Masked())
+				label := defaultLabel
+				if _, v, ok := table.ParentOf(p); ok {
+					label = v
+				}
+				b.WriteString(delimiter)
+				b.WriteString(label)
+			}
+			fmt.Println(b.String())
+			return nil
+		},
+	}
+
+	Logf("Processing input CIDRs\n")
+	return iterPathArgs(c, func(r io.Reader) error {
+		return pr.Process(r)
+	})
+}
+
+// openPathArg opens the file at path, or returns stdin if path is "-".
+func openPathArg(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+func handleJoin(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return fmt.Errorf("Expected 2 paths, got %d", c.NArg())
+	}
+	delimiter := UnescapeDelimiter(c.String("delimiter"))
+	mode := c.String("mode")
+	joinType := c.String("type")
+
+	// Load the right file, indexing each line by the CIDRs in its field. A
+	// range yields several CIDRs, but the line is still joined only once.
+	type rightLine struct {
+		raw      string
+		prefixes []netip.Prefix
+	}
+	rightLines := []rightLine{}
+	linesByPrefix := map[netip.Prefix][]int{}
+	rightPr := CidrProcessor{
+		Fields:    []int{c.Int("right-field")},
+		Delimiter: delimiter,
+		ValParser: ParsePrefixOrAddr,
+		ErrFn:     errorHandler,
+		HandlerFn: func(parsed *ParsedLine) error {
+			for _, p := range parsed.Prefixes {
+				p = p.Masked()
+				linesByPrefix[p] = append(linesByPrefix[p], len(rightLines))
+			}
+			rightLines = append(rightLines, rightLine{parsed.Raw, parsed.Prefixes})
+			return nil
+		},
+	}
+	Logf("Loading right file '%s'\n", c.Args().Get(1))
+	r, err := openPathArg(c.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err = rightPr.Process(r); err != nil {
+		return err
+	}
+	pmb := netipds.PrefixMapBuilder[[]int]{}
+	for p, lines := range linesByPrefix {
+		pmb.Set(p, lines)
+	}
+	right := pmb.PrefixMap()
+
+	// bounds returns the first and last addresses covered by the Prefixes of a
+	// field, which are contiguous even if the field is a range.
+	bounds := func(prefixes []netip.Prefix) (netip.Addr, netip.Addr) {
+		return prefixes[0].Masked().Addr(), LastAddr(prefixes[len(prefixes)-1])
+	}
+
+	// joined returns the right lines joined to the left field with the given
+	// Prefixes, ordered by CIDR (or the start of their range). Fields are
+	// compared as a whole, so a range contains or equals another field only if
+	// all of it does.
+	joined := func(prefixes []netip.Prefix) []string {
+		// Every joined line overlaps the left field
+		candidates := map[int]bool{}
+		for _, p := range prefixes {
+			p = p.Masked()
+			for _, lines := range right.AncestorsOf(p).ToMap() {
+				for _, i := range lines {
+					candidates[i] = true
+				}
+			}
+			for _, lines := range right.DescendantsOf(p).ToMap() {
+				for _, i := range lines {
+					candidates[i] = true
+				}
+			}
+		}
+		first, last := bounds(prefixes)
+		matches := []int{}
+		for i := range candidates {
+			rFirst, rLast := bounds(rightLines[i].prefixes)
+			switch mode {
+			case "contains":
+				if rFirst.Compare(first) > 0 || rLast.Compare(last) < 0 {
+					continue
+				}
+			case "equal":
+				if rFirst != first || rLast != last {
+					continue
+				}
+			}
+			matches = append(matches, i)
+		}
+		slices.SortFunc(matches, func(i, j int) int {
+			if c := PrefixCompare(rightLines[i].prefixes[0], rightLines[j].prefixes[0]); c != 0 {
+				return c
+			}
+			return i - j
+		})
+		res := make([]string, len(matches))
+		for k, i := range matches {
+			res[k] = rightLines[i].raw
+		}
+		return res
+	}
+
+	// Join each line of the left file
+	leftPr := CidrProcessor{
+		Fields:    []int{c.Int("left-field")},
+		Delimiter: delimiter,
+		ValParser: ParsePrefixOrAddr,
+		ErrFn:     errorHandler,
+		HandlerFn: func(parsed *ParsedLine) error {
+			lines := joined(parsed.Prefixes)
+			switch {
+			case len(lines) == 0 && joinType != "inner":
+				fmt.Println(parsed.Raw)
+			case joinType != "anti":
+				for _, line := range lines {
+					fmt.Println(parsed.Raw + delimiter + line)
+				}
+			}
+			return nil
+		},
+	}
+	Logf("Joining left file '%s'\n", c.Args().Get(0))
+	l, err := openPathArg(c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return leftPr.Process(l)
+}
+
+func handleWhich(c *cli.Context) error {
+	delimiter := UnescapeDelimiter(c.String("delimiter"))
+	overlap := c.String("mode") == "overlap"
+
+	// Collect list arguments, including the files in each --dir
+	listArgs := c.StringSlice("list")
+	for _, dir := range c.StringSlice("dir") {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			listArgs = append(listArgs, filepath.Join(dir, entry.Name()))
+		}
+	}
+	if len(listArgs) == 0 {
+		return fmt.Errorf("No lists provided; use --list or --dir")
+	}
+
+	// Name each list by its file name, unless another list has the same file
+	// name, in which case the full argument is used
+	names := make([]string, len(listArgs))
+	baseCounts := map[string]int{}
+	for _, listArg := range listArgs {
+		baseCounts[filepath.Base(listArg)]++
+	}
+	for i, listArg := range listArgs {
+		names[i] = listArg
+		if !strings.HasPrefix(listArg, "@") && baseCounts[filepath.Base(listArg)] == 1 {
+			names[i] = filepath.Base(listArg)
+		}
+	}
+
+	// Build an index from each CIDR to the (indexes of) lists containing it
+	listsByPrefix := map[netip.Prefix][]int{}
+	for i, listArg := range listArgs {
+		Logf("Loading list '%s'\n", listArg)
+		ps, err := LoadPrefixSet(listArg, errorHandler)
+		if err != nil {
+			return err
+		}
+		for _, p := range ps.Prefixes() {
+			listsByPrefix[p] = append(listsByPrefix[p], i)
+		}
+	}
+	pmb := netipds.PrefixMapBuilder[[]int]{}
+	for p, lists := range listsByPrefix {
+		pmb.Set(p, lists)
+	}
+	index := pmb.PrefixMap()
+
+	// listsFor returns which lists contain (or overlap) p.
+	listsFor := func(p netip.Prefix) []bool {
+		p = p.Masked()
+		inList := make([]bool, len(names))
+		for _, lists := range index.AncestorsOf(p).ToMap() {
+			for _, i := range lists {
+				inList[i] = true
+			}
+		}
+		if overlap {
+			for _, lists := range index.DescendantsOf(p).ToMap() {
+				for _, i := range lists {
+					inList[i] = true
+				}
+			}
+		}
+		return inList
+	}
+
+	// which returns the names of the lists which contain (or overlap) the
+	// Prefixes of a field. A list contains a range if it contains every one
+	// of its Prefixes, and overlaps it if it overlaps any of them.
+	which := func(prefixes []netip.Prefix) string {
+		inList := listsFor(prefixes[0])
+		for _, p := range prefixes[1:] {
+			for i, in := range listsFor(p) {
+				if overlap {
+					inList[i] = inList[i] || in
+				} else {
+					inList[i] = inList[i] && in
+				}
+			}
+		}
+		res := []string{}
+		for i, name := range names {
+			if inList[i] {
+				res = append(res, name)
+			}
+		}
+		return strings.Join(res, ",")
+	}
+
+	// Set up processor
+	pr := CidrProcessor{
+		Fields:    c.IntSlice("field"),
+		Delimiter: delimiter,
+		ValParser: ValParser(c.Bool("url"), c.Bool("host")),
+		ErrFn:     errorHandler,
+		HandlerFn: func(parsed *ParsedLine) error {
+			b := strings.Builder{}
+			b.WriteString(parsed.Raw)
+			for _, pf := range parsed.ParsedFields() {
+				b.WriteString(delimiter)
+				b.WriteString(which(pf.Prefixes))
+			}
+			fmt.Println(b.String())
+			return nil
+		},
+	}
+
+	Logf("Processing input CIDRs\n")
+	return iterPathArgs(c, func(r io.Reader) error {
+		return pr.Process(r)
+	})
+}
+
+func handleStats(c *cli.Context) error {
+	stats := newPrefixStats()
+
+	// Set up processor
+	p := CidrProcessor{
+		ValParser: ParsePrefixOrAddr,
+		HandlerFn: func(parsed *ParsedLine) error {
+			for _, prefix := range parsed.Prefixes {
+				stats.Add(prefix)
+			}
+			return nil
+		},
+		ErrFn: errorHandler,
+	}
+
+	Logf("Loading input CIDRs\n")
+	err := iterPathArgs(c, func(r io.Reader) error {
+		return p.Process(r)
+	})
+	if err != nil {
+		return err
+	}
+
+	stats.Finish()
+	if c.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	}
+	stats.Print(os.Stdout)
+	return nil
+}
+
+func handleTree(c *cli.Context) error {
+	cp, psb := PrefixSetBuilderCidrProcessor()
+
+	Logf("Loading input CIDRs\n")
+	err := iterPathArgs(c, func(r io.Reader) error {
+		return cp.Process(r)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Prefixes are returned in sorted order, with each prefix followed by its
+	// descendants, so each prefix is indented by its number of ancestors.
+	ps := psb.PrefixSet()
+	Logf("Done loading CIDRs\n")
+	for _, p := range ps.Prefixes() {
+		depth := ps.AncestorsOf(p).Size() - 1
+		line := strings.Repeat("  ", depth) + StringMaybeAddr(p)
+		if depth > 0 {
+			line += " (redundant)"
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func handleExpand(c *cli.Context) error {
+	maxAddrs := big.NewInt(c.Int64("max"))
+	hosts := c.Bool("hosts")
+	step := big.NewInt(c.Int64("step"))
+	sample := c.Int64("sample")
+	if step.Sign() <= 0 {
+		return fmt.Errorf("Invalid step: %s", step)
+	}
+	if sample > 0 && step.Cmp(big.NewInt(1)) != 0 {
+		return fmt.Errorf("--sample and --step cannot be used together")
+	}
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	total := big.NewInt(0)
+
+	// Set up processor
+	p := CidrProcessor{
+		ValParser: ParsePrefixOrAddr,
+		HandlerFn: func(parsed *ParsedLine) error {
+			for _, prefix := range parsed.Prefixes {
+				first, last := prefix.Masked().Addr(), LastAddr(prefix)
+				count := PrefixSize(prefix)
+				if hosts && first.Is4() && prefix.Bits() < 31 {
+					first, last = first.Next(), last.Prev()
+					count.Sub(count, big.NewInt(2))
+				}
+
+				// Determine how many addresses will be printed
+				n := new(big.Int).Sub(count, big.NewInt(1))
+				n.Div(n, step).Add(n, big.NewInt(1))
+				if sample > 0 && n.Cmp(big.NewInt(sample)) > 0 {
+					n.SetInt64(sample)
+				}
+				total.Add(total, n)
+				if maxAddrs.Sign() > 0 && total.Cmp(maxAddrs) > 0 {
+					total.Sub(total, n)
+					return fmt.Errorf(
+						"Expanding %s would exceed --max %s addresses",
+						StringMaybeAddr(prefix), maxAddrs)
+				}
+
+				// Print a random sample of offsets, if requested
+				if sample > 0 && n.Cmp(count) < 0 {
+					offsets := map[string]*big.Int{}
+					for int64(len(offsets)) < sample {
+						o := new(big.Int).Rand(rng, count)
+						offsets[o.String()] = o
+					}
+					sorted := make([]*big.Int, 0, len(offsets))
+					for _, o := range offsets {
+						sorted = append(sorted, o)
+					}
+					slices.SortFunc(sorted, (*big.Int).Cmp)
+					for _, o := range sorted {
+						addr, _ := AddrAdd(first, o)
+						fmt.Println(addr)
+					}
+					continue
+				}
+
+				// Otherwise, print every step-th address
+				for addr, ok := first, true; ok && addr.Compare(last) <= 0; {
+					fmt.Println(addr)
+					if addr == last {
+						break
+					}
+					if step.IsInt64() && step.Int64() == 1 {
+						addr = addr.Next()
+					} else {
+						addr, ok = AddrAdd(addr, step)
+					}
+				}
+			}
+			return nil
+		},
+		ErrFn: errorHandler,
+	}
+
+	return iterPathArgs(c, func(r io.Reader) error {
+		return p.Process(r)
+	})
+}
+
+func handleSplit(c *cli.Context) error {
+	bits := c.Int("bits")
+	count := c.Int64("count")
+	maxPrefixes := big.NewInt(c.Int64("max"))
+	if (bits > 0) == (count > 0) {
+		return fmt.Errorf("Exactly one of --bits or --count is required")
+	}
+	if count > 0 && count&(count-1) != 0 {
+		return fmt.Errorf("Invalid count: %d (must be a power of two)", count)
+	}
+	total := big.NewInt(0)
+
+	// Set up processor
+	p := CidrProcessor{
+		ValParser: ParsePrefixOrAddr,
+		HandlerFn: func(parsed *ParsedLine) error {
+			for _, prefix := range parsed.Prefixes {
+				prefix = prefix.Masked()
+				target := bits
+				if count > 0 {
+					target = prefix.Bits() + big.NewInt(count).BitLen() - 1
+				}
+
+				// Leave prefixes that are already small enough unchanged
+				if target <= prefix.Bits() {
+					fmt.Println(StringMaybeAddr(prefix))
+					continue
+				}
+				if target > prefix.Addr().BitLen() {
+					return fmt.Errorf("Cannot split %s into /%d subnets",
+						StringMaybeAddr(prefix), target)
+				}
+
+				n := new(big.Int).Lsh(big.NewInt(1), uint(target-prefix.Bits()))
+				total.Add(total, n)
+				if maxPrefixes.Sign() > 0 && total.Cmp(maxPrefixes) > 0 {
+					total.Sub(total, n)
+					return fmt.Errorf(
+						"Splitting %s would exceed --max %s prefixes",
+						StringMaybeAddr(prefix), maxPrefixes)
+				}
+
+				last := LastAddr(prefix)
+				for sub := netip.PrefixFrom(prefix.Addr(), target); ; {
+					fmt.Println(StringMaybeAddr(sub))
+					subLast := LastAddr(sub)
+					if subLast == last {
+						break
+					}
+					sub = netip.PrefixFrom(subLast.Next(), target)
+				}
+			}
+			return nil
+		},
+		ErrFn: errorHandler,
+	}
+
+	return iterPathArgs(c, func(r io.Reader) error {
+		return p.Process(r)
+	})
+}
+
+func handleGaps(c *cli.Context) error {
+	bits := c.Int("bits")
+	maxPrefixes := big.NewInt(c.Int64("max"))
+
+	freePsb, err := PrefixSetBuilderFromStrings(c.StringSlice("within"))
+	if err != nil {
+		return err
+	}
+
+	// Load allocated CIDRs
+	cp, usedPsb := PrefixSetBuilderCidrProcessor()
+	err = iterPathArgs(c, func(r io.Reader) error {
+		return cp.Process(r)
+	})
+	if err != nil {
+		return err
+	}
+	PrefixSetBuilderSubtract(freePsb, usedPsb.PrefixSet())
+
+	// Output free space, optionally as blocks of a fixed size
+	free := freePsb.PrefixSet().PrefixesCompact()
+	if bits == 0 {
+		for _, p := range free {
+			fmt.Println(StringMaybeAddr(p))
+		}
+		return nil
+	}
+	blocks := []netip.Prefix{}
+	total := big.NewInt(0)
+	for _, p := range free {
+		if bits >= p.Bits() && bits <= p.Addr().BitLen() {
+			blocks = append(blocks, p)
+			total.Add(total, new(big.Int).Lsh(big.NewInt(1), uint(bits-p.Bits())))
+		}
+	}
+	if maxPrefixes.Sign() > 0 && total.Cmp(maxPrefixes) > 0 {
+		return fmt.Errorf("Listing %s free /%d blocks would exceed --max %s "+
+			"prefixes", total, bits, maxPrefixes)
+	}
+	for _, p := range blocks {
+		EachSubnet(p, bits, func(sub netip.Prefix) {
+			fmt.Println(StringMaybeAddr(sub))
+		})
+	}
+	return nil
+}
+
+func handleAllocate(c *cli.Context) error {
+	bits := c.Int("bits")
+	align := c.Int("align")
+	if align > bits {
+		return fmt.Errorf("Invalid alignment: /%d is longer than /%d", align, bits)
+	}
+	if c.Bool("append") && !c.IsSet("used") {
+		return fmt.Errorf("--append requires --used")
+	}
+	if c.IsSet("used") && !c.Bool("append") {
+		if err := validatePath(c, c.String("used")); err != nil {
+			return err
+		}
+	}
+
+	// With --append, hold a lock from reading the used file until it has been
+	// replaced, so that concurrent runs never allocate the same CIDRs. The
+	// lock is taken on a separate file, since the used file is replaced.
+	if c.Bool("append") {
+		used := c.String("used")
+		unlock, err := LockFile(
+			filepath.Join(filepath.Dir(used), "."+filepath.Base(used)+".lock"))
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	// Free space is the pool minus anything already used
+	freePsb, err := LoadPrefixSetBuilder(c.String("pool"), errorHandler)
+	if err != nil {
+		return err
+	}
+	if c.IsSet("used") {
+		usedPs, err := LoadPrefixSetFromFile(c.String("used"), errorHandler)
+		if err != nil && !(c.Bool("append") && errors.Is(err, fs.ErrNotExist)) {
+			return err
+		}
+		if usedPs != nil {
+			PrefixSetBuilderSubtract(freePsb, usedPs)
+		}
+	}
+
+	allocated, err := AllocatePrefixes(freePsb, bits, align, c.Int("count"),
+		c.String("strategy") == "best")
+	if err != nil {
+		return err
+	}
+	lines := make([]string, len(allocated))
+	for i, p := range allocated {
+		lines[i] = StringMaybeAddr(p)
+	}
+	if c.Bool("append") {
+		if err = AppendLinesAtomic(c.String("used"), lines); err != nil {
+			return err
+		}
+	}
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func handleContains(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("A set of CIDRs is required")
+	}
+	if err := validateListArgs(c, c.Args().Slice()[:1]); err != nil {
+		return err
+	}
+	memberFn := prefixSetMembershipFn(c.String("mode"))
+	anyMode := c.Bool("any")
 
-	quiet := c.Bool("quiet")
-	clean := c.Bool("clean")
-	matchFn := prefixSetMembershipFn(c.String("match-mode"))
-	excludeFn := prefixSetMembershipFn(c.String("exclude-mode"))
-
-	if !quiet {
-		// --exclude
-		if excludePath := c.String("exclude"); excludePath != "" {
-			Logf("Loading exclude file '%s'\n", c.String("exclude"))
-			excludeSet, err = LoadPrefixSetFromFile(excludePath, errorHandler)
-			if err != nil {
-				return err
-			}
+	Logf("Loading set '%s'\n", c.Args().First())
+	set, err := LoadPrefixSet(c.Args().First(), errorHandler)
+	if err != nil {
+		return err
+	}
+
+	// With --any, stop at the first member; otherwise, at the first non-member
+	checked, found, missing := 0, false, false
+	// A range is checked as a unit (see prefixSetMembershipFn)
+	check := func(addr string, prefixes []netip.Prefix) bool {
+		checked++
+		if memberFn(set, prefixes) {
+			found = true
+		} else {
+			Logf("%s is not in the set\n", addr)
+			missing = true
 		}
+		return (anyMode && found) || (!anyMode && missing)
+	}
 
-		// --match
-		if matchPath := c.String("match"); matchPath != "" {
-			Logf("Loading match file '%s'\n", c.String("match"))
-			matchPsb, err := LoadPrefixSetBuilderFromFile(matchPath, errorHandler)
+	if c.NArg() > 1 {
+	args:
+		for _, arg := range c.Args().Tail() {
+			arg = strings.TrimSpace(arg)
+			prefixes, err := ParsePrefixOrAddr(arg)
 			if err != nil {
 				return err
 			}
-			if excludeSet != nil {
-				for _, excludePrefix := range excludeSet.Prefixes() {
-					matchPsb.SubtractPrefix(excludePrefix)
-				}
+			if check(arg, prefixes) {
+				break args
 			}
-			matchSet = matchPsb.PrefixSet()
 		}
-	}
-
-	// Set up processor
-	fields := c.IntSlice("field")
-	pr := CidrProcessor{
-		Fields:    fields,
-		Delimiter: c.String("delimiter"),
-		ValParser: ValParser(c.Bool("url"), c.Bool("host")),
-		ErrFn:     errorHandler,
-		HandlerFn: func(parsed *ParsedLine) error {
-			anyPassed := false
-			for _, p := range parsed.Prefixes {
-				// In quiet mode, the filter just parses and validates input CIDRs.
-				if quiet {
-					continue
-				}
-
-				// Skip the prefix if it doesn't match any match lists.
-				if matchSet != nil && !matchFn(matchSet, p) {
-					continue
+	} else {
+		p := CidrProcessor{
+			ValParser: ParsePrefixOrAddr,
+			HandlerFn: func(parsed *ParsedLine) error {
+				if check(parsed.Raw, parsed.Prefixes) {
+					return ErrStopProcessing
 				}
-
-				// Skip the prefix if it matches an exclude list.
-				if excludeSet != nil && excludeFn(excludeSet, p) {
-					continue
-				}
-				anyPassed = true
-			}
-
-			if !anyPassed {
 				return nil
-			}
-
-			if clean {
-				fmt.Println(parsed.Clean())
-			} else {
-				fmt.Println(parsed.Raw)
-			}
-			return nil
-		},
+			},
+			ErrFn: errorHandler,
+		}
+		if err = p.Process(os.Stdin); err != nil {
+			return err
+		}
 	}
 
-	Logf("Processing input CIDRs\n")
-	return iterPathArgs(c, func(r io.Reader) error {
-		return pr.Process(r)
-	})
+	if checked == 0 || (anyMode && !found) || (!anyMode && missing) {
+		return errNoMatch
+	}
+	return nil
 }
 
 func handleSort(c *cli.Context) error {
 	sorted := netipds.PrefixSetBuilder{}
+	maxBits := c.Int("max-aggregate-bits")
+	checkSplit := splitLimitFn(c)
 
 	// Set up processor
 	p := CidrProcessor{
 		ValParser: ParsePrefixOrAddr,
 		HandlerFn: func(parsed *ParsedLine) error {
 			for _, prefix := range parsed.Prefixes {
+				if maxBits > 0 {
+					if err := checkSplit(prefix, maxBits); err != nil {
+						return err
+					}
+				}
 				// TODO need a way to merge redundant prefixes
-				sorted.Add(prefix)
+				EachSubnet(prefix, min(maxBits, prefix.Addr().BitLen()),
+					func(sub netip.Prefix) { sorted.Add(sub) })
 			}
 			return nil
 		},
@@ -308,15 +1259,23 @@ func handleSort(c *cli.Context) error {
 	// Output sorted CIDR set
 	sortedPrefixSet := sorted.PrefixSet()
 	Logf("Done loading CIDRs\n")
-	for _, p := range sortedPrefixSet.Prefixes() {
-		fmt.Println(StringMaybeAddr(p))
+	prefixes := sortedPrefixSet.Prefixes()
+	if minBits := c.Int("min-aggregate-bits"); minBits > 0 {
+		prefixes = MergeSiblings(prefixes, max(minBits, maxBits))
+	}
+	for _, p := range prefixes {
+		if c.Bool("ranges") {
+			fmt.Println(PrefixRanges([]netip.Prefix{p})[0])
+		} else {
+			fmt.Println(StringMaybeAddr(p))
+		}
 	}
 	return nil
 }
 
-func main() {
-
-	app := &cli.App{
+// newApp returns the cidrq command-line app.
+func newApp() *cli.App {
+	return &cli.App{
 		Name:  "cidrq",
 		Usage: "CIDR manipulation tool",
 		Authors: []*cli.Author{
@@ -358,6 +1317,50 @@ func main() {
 				ArgsUsage: "[paths]",
 				Action:    handleCombine,
 				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "ranges",
+						Aliases: []string{"r"},
+						Usage: "Print the output as ranges of addresses " +
+							"(e.g. 10.0.0.5-10.0.1.200) rather than CIDRs, " +
+							"merging adjacent CIDRs into a single range.",
+					},
+					&cli.IntFlag{
+						Name: "max-aggregate-bits",
+						Usage: "Never print CIDRs shorter than /`N`; shorter " +
+							"CIDRs are split into their /N subnets.",
+						Action: validateAggregateBits,
+					},
+					&cli.Int64Flag{
+						Name: "max-split",
+						Usage: "Fail before --max-aggregate-bits splits CIDRs " +
+							"into more than `N` subnets in total. Use 0 for no " +
+							"limit.",
+						Value: 65536,
+					},
+					&cli.IntFlag{
+						Name: "min-aggregate-bits",
+						Usage: "Merge sibling CIDRs (the two halves of a " +
+							"common parent) into their parent, as long as " +
+							"the parent is no shorter than /`N`. This never " +
+							"adds addresses.",
+						Action: validateAggregateBits,
+					},
+					&cli.IntFlag{
+						Name: "max-prefixes",
+						Usage: "Merge the output into at most `N` CIDRs, " +
+							"adding as few extra addresses as possible. The " +
+							"number of extra addresses is printed to stderr.",
+					},
+					&cli.StringFlag{
+						Name: "forbid",
+						Usage: "With --max-prefixes, never merge CIDRs into a " +
+							"CIDR overlapping the CIDRs in `FILE` (or a named " +
+							"set, e.g. @bogons).",
+						TakesFile: true,
+						Action: func(c *cli.Context, v string) error {
+							return validateListArgs(c, []string{v})
+						},
+					},
 					&cli.StringFlag{
 						Name:    "union",
 						Aliases: []string{"u"},
@@ -410,49 +1413,135 @@ func main() {
 				Aliases:   []string{"s"},
 				ArgsUsage: "[paths]",
 				Action:    handleSort,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "ranges",
+						Aliases: []string{"r"},
+						Usage: "Print each CIDR as a range of addresses " +
+							"(e.g. 10.0.0.0-10.0.0.255).",
+					},
+					&cli.IntFlag{
+						Name: "max-aggregate-bits",
+						Usage: "Never print CIDRs shorter than /`N`; shorter " +
+							"CIDRs are split into their /N subnets.",
+						Action: validateAggregateBits,
+					},
+					&cli.Int64Flag{
+						Name: "max-split",
+						Usage: "Fail before --max-aggregate-bits splits CIDRs " +
+							"into more than `N` subnets in total. Use 0 for no " +
+							"limit.",
+						Value: 65536,
+					},
+					&cli.IntFlag{
+						Name: "min-aggregate-bits",
+						Usage: "Merge sibling CIDRs (the two halves of a " +
+							"common parent) into their parent, as long as " +
+							"the parent is no shorter than /`N`. This never " +
+							"adds addresses.",
+						Action: validateAggregateBits,
+					},
+				},
 			},
 			{
-				Name:      "filter",
-				Usage:     "Filter lists of CIDRs",
-				Aliases:   []string{"f"},
+				Name:    "filter",
+				Usage:   "Filter lists of CIDRs",
+				Aliases: []string{"f"},
+				Description: "Print the input lines containing CIDRs that " +
+					"pass the provided match lists, exclude lists and " +
+					"address properties. Like grep, the exit status is 0 " +
+					"if any line passed, 1 if none did, and 2 if an error " +
+					"occurred. An input range of addresses (e.g. " +
+					"10.0.0.5-10.0.1.200) passes or fails as a unit: in " +
+					"overlap and contains modes any part of it may match, " +
+					"in coverage mode the whole range is measured, and in " +
+					"the other modes every part of it must match.",
 				ArgsUsage: "[paths]",
 				Flags: []cli.Flag{
-					&cli.StringFlag{
+					&cli.StringSliceFlag{
 						Name:    "exclude",
 						Aliases: []string{"x"},
 						Usage: "Path to CIDR exclusion list. Input lines " +
 							"containing CIDRs found in `FILE` will be omitted " +
-							"from the output.",
-						Action: validatePath,
+							"from the output. May be provided multiple times; " +
+							"CIDRs found in any exclusion list are excluded. " +
+							"Instead of a path, a built-in named set may be " +
+							"given (see --match). Use N=FILE to apply the " +
+							"list only to field N, in addition to the lists " +
+							"that apply to all fields.",
+						Action: validateListArgs,
+					},
+					&cli.StringSliceFlag{
+						Name: "exclude-cidr",
+						Usage: "Comma-separated `CIDRS` to exclude, as if " +
+							"they were provided in an exclusion list.",
 					},
 					&cli.StringFlag{
 						Name:  "exclude-mode",
 						Value: "encompass",
 						Usage: "Comparison strategy for exclude list (overlap, " +
-							"encompass). In overlap mode, an input CIDR is " +
+							"encompass, cover, coverage:FRACTION, exact, " +
+							"contains). In overlap mode, an input CIDR is " +
 							"excluded if it overlaps any CIDR in an exclude " +
 							"list. In encompass mode, an input CIDR is only " +
 							"excluded if it has a parent in an exclude list. " +
-							"Default: encompass.",
+							"In cover mode, an input CIDR is excluded if it is " +
+							"fully covered by the union of the CIDRs in an " +
+							"exclude list. In coverage mode, an input CIDR is " +
+							"excluded if at least FRACTION (0-1) of its " +
+							"addresses are in an exclude list. In exact mode, " +
+							"an input CIDR is excluded only if it appears " +
+							"verbatim in an exclude list. In contains mode, an " +
+							"input CIDR is excluded if it contains any CIDR in " +
+							"an exclude list. Default: encompass.",
 						Action: validateExcludeMode,
 					},
-					&cli.StringFlag{
+					&cli.StringSliceFlag{
 						Name:    "match",
 						Aliases: []string{"m"},
 						Usage: "Path to CIDR match list. The filter will permit " +
 							"any input lines containing CIDRs that match any of " +
 							"the CIDRs in `FILE`. If -exclude is provided, it will " +
-							"be applied after matching.",
-						Action: validatePath,
+							"be applied after matching. May be provided " +
+							"multiple times; by default, the match lists are " +
+							"combined as a union (see --match-all). Instead " +
+							"of a path, a built-in named set may be given: " +
+							"@rfc1918, @loopback, @linklocal, @multicast, " +
+							"@documentation, @cgnat or @bogons. Use N=FILE " +
+							"to apply the list only to field N, in place of " +
+							"the lists that apply to all fields; input lines " +
+							"are then printed only if field N matches.",
+						Action: validateListArgs,
+					},
+					&cli.StringSliceFlag{
+						Name: "match-cidr",
+						Usage: "Comma-separated `CIDRS` to match, as if they " +
+							"were provided in a match list.",
+					},
+					&cli.BoolFlag{
+						Name: "match-all",
+						Usage: "Require an input CIDR to match every list " +
+							"provided via --match, rather than any of them.",
 					},
 					&cli.StringFlag{
 						Name:  "match-mode",
 						Value: "overlap",
 						Usage: "Comparison strategy for match list (overlap, " +
-							"encompass). In overlap mode, an input CIDR is " +
-							"a match if it overlaps any CIDR in a match list. " +
-							"In encompass mode, an input CIDR matches only if " +
-							"it has a parent in a match list. Default: overlap.",
+							"encompass, cover, coverage:FRACTION, exact, " +
+							"contains). In overlap mode, an input CIDR is a " +
+							"match if it overlaps any CIDR in a match list. In " +
+							"encompass mode, an input CIDR matches only if it " +
+							"has a parent in a match list. In cover mode, an " +
+							"input CIDR matches if it is fully covered by the " +
+							"union of the CIDRs in a match list, e.g. a /23 " +
+							"matches a list containing both of its /24s. In " +
+							"coverage mode, an input CIDR matches if at least " +
+							"FRACTION (0-1) of its addresses are in a match " +
+							"list, e.g. coverage:0.5. In exact mode, an input " +
+							"CIDR matches only if it appears verbatim in a " +
+							"match list. In contains mode, an input CIDR " +
+							"matches if it contains any CIDR in a match list. " +
+							"Default: overlap.",
 						Action: validateMatchMode,
 					},
 					&cli.IntSliceFlag{
@@ -463,6 +1552,44 @@ func main() {
 							"Parsing is performed only on input CIDRs, not " +
 							"exclusion or match lists.",
 					},
+					&cli.BoolFlag{
+						Name:    "ipv4",
+						Aliases: []string{"4"},
+						Usage:   "Permit only IPv4 CIDRs.",
+					},
+					&cli.BoolFlag{
+						Name:    "ipv6",
+						Aliases: []string{"6"},
+						Usage:   "Permit only IPv6 CIDRs.",
+					},
+					&cli.IntFlag{
+						Name:  "min-bits",
+						Usage: "Permit only CIDRs with a prefix length of at least `N`.",
+					},
+					&cli.IntFlag{
+						Name:  "max-bits",
+						Usage: "Permit only CIDRs with a prefix length of at most `N`.",
+					},
+					&cli.StringSliceFlag{
+						Name: "is",
+						Usage: "Permit only CIDRs whose addresses all belong to " +
+							"`CLASS` (private, global, loopback, multicast, " +
+							"linklocal, unspecified). Global addresses are " +
+							"unicast addresses that are not private. May be " +
+							"provided multiple times to permit any of several " +
+							"classes.",
+						Action: validateClasses,
+					},
+					&cli.StringFlag{
+						Name:  "require",
+						Value: "any",
+						Usage: "When multiple fields are selected, whether " +
+							"any of them or all of them must pass the match " +
+							"and exclude lists for a line to be printed (any, " +
+							"all). Fields with their own lists (N=FILE) must " +
+							"always pass. Default: any.",
+						Action: validateRequire,
+					},
 					&cli.StringFlag{
 						Name:    "delimiter",
 						Aliases: []string{"d"},
@@ -473,16 +1600,36 @@ func main() {
 						Name:    "quiet",
 						Aliases: []string{"q"},
 						Usage: "Suppress stdout. If -err == print, error lines " +
-							"are still printed.",
+							"are still printed. The exit status still " +
+							"reports whether any line passed the filter.",
 						Value: false,
 					},
+					&cli.BoolFlag{
+						Name: "count",
+						Usage: "Print only the number of input lines that " +
+							"passed the filter.",
+					},
+					&cli.IntFlag{
+						Name: "max-count",
+						Usage: "Stop reading input after `N` lines have " +
+							"passed the filter.",
+					},
 					&cli.BoolFlag{
 						Name:    "clean",
 						Aliases: []string{"c"},
 						Usage: "Replace selected fields with their respective " +
-							"parsed CIDRs",
+							"parsed CIDRs. A field holding a range of " +
+							"addresses is printed as a range, since it may " +
+							"span several CIDRs.",
 						Value: false,
 					},
+					&cli.BoolFlag{
+						Name:    "ranges",
+						Aliases: []string{"r"},
+						Usage: "With --clean, replace selected fields with " +
+							"the ranges of addresses covered by their parsed " +
+							"CIDRs (e.g. 10.0.0.5-10.0.1.200).",
+					},
 					&cli.BoolFlag{
 						Name:    "url",
 						Aliases: []string{"u"},
@@ -495,18 +1642,442 @@ func main() {
 						Usage: "Accept a host[:port] as valid if the host is " +
 							"a valid IP.",
 					},
+					&cli.BoolFlag{
+						Name:    "invert",
+						Aliases: []string{"V"},
+						Usage: "Invert the filter: print only the input lines " +
+							"that would otherwise be omitted, i.e. lines with " +
+							"no CIDRs in the match list, or whose CIDRs are " +
+							"excluded. With --flat, print the CIDRs that would " +
+							"otherwise be omitted.",
+					},
+					&cli.BoolFlag{
+						Name: "explain",
+						Usage: "For each input CIDR (or range), write a line " +
+							"to stderr showing the CIDR, whether it passed (pass or " +
+							"drop, taking into account --invert, --require " +
+							"and per-field lists), and the entries in the match and exclude " +
+							"lists responsible, as the longest-prefix match " +
+							"in each list (or, if there is none, the first " +
+							"list entry within the CIDR). Example: " +
+							"10.4.5.6<TAB>pass<TAB>match=10.0.0.0/8<TAB>" +
+							"exclude=-",
+					},
 					&cli.BoolFlag{
 						Name:    "flat",
 						Aliases: []string{"F"},
-						// TODO apply exclusion list after matching lines,
-						// before printing
-						Usage: "Print each matched CIDR on a separate line.",
+						Usage: "Print each matched CIDR on a separate line, " +
+							"rather than the whole input line. CIDRs that " +
+							"are excluded are omitted. With --clean, the " +
+							"parsed CIDR is printed instead of the original " +
+							"field.",
 					},
 				},
 				Action: handleFilter,
 			},
+			{
+				Name:  "lookup",
+				Usage: "Label CIDRs using a table of CIDRs and labels",
+				Description: "Load a table of rows of the form " +
+					"CIDR<delimiter>LABEL from --table, and for each input " +
+					"line, append the label of the longest-prefix match of " +
+					"each selected field as a new column. The label is the " +
+					"remainder of the table row after the first delimiter. " +
+					"For a range, the label is that of the longest table " +
+					"CIDR containing the whole range.",
+				Aliases:   []string{"l"},
+				ArgsUsage: "[paths]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "table",
+						Aliases: []string{"t"},
+						Usage: "Path to a `FILE` containing a table of CIDRs " +
+							"and labels, separated by the delimiter provided " +
+							"via -d.",
+						Required:  true,
+						TakesFile: true,
+						Action:    validatePath,
+					},
+					&cli.StringFlag{
+						Name: "default",
+						Usage: "`LABEL` to append when an input CIDR has no " +
+							"match in the table.",
+					},
+					&cli.IntSliceFlag{
+						Name:    "field",
+						Aliases: []string{"f"},
+						Usage: "Instruct cidrq to look for CIDRs in one or more " +
+							"fields, where field delimiter is provided via -d.",
+					},
+					&cli.StringFlag{
+						Name:    "delimiter",
+						Aliases: []string{"d"},
+						Usage: "Delimiter for field separation in input " +
+							"lines, the table and the appended columns " +
+							"(use '\\t' for tab).",
+						Value: "\\t",
+					},
+					&cli.BoolFlag{
+						Name:    "clean",
+						Aliases: []string{"c"},
+						Usage: "Replace selected fields with their respective " +
+							"parsed CIDRs. A field holding a range of " +
+							"addresses is printed as a range, since it may " +
+							"span several CIDRs.",
+					},
+					&cli.BoolFlag{
+						Name:    "url",
+						Aliases: []string{"u"},
+						Usage: "Accept a URL as valid if the hostname is a " +
+							"valid IP.",
+					},
+					&cli.BoolFlag{
+						Name:    "host",
+						Aliases: []string{"H"},
+						Usage: "Accept a host[:port] as valid if the host is " +
+							"a valid IP.",
+					},
+				},
+				Action: handleLookup,
+			},
+			{
+				Name:  "join",
+				Usage: "Join two files on CIDR containment",
+				Description: "Join each line of the left file to every " +
+					"line of the right file whose CIDR field contains the " +
+					"left file's CIDR field (or overlaps or equals it, see " +
+					"--mode). Joined lines are printed as the left line " +
+					"followed by the right line, separated by the " +
+					"delimiter. Either path may be '-' for stdin. A range " +
+					"of addresses is compared as a whole, e.g. it contains " +
+					"another field only if it contains all of it.",
+				Aliases:   []string{"j"},
+				ArgsUsage: "LEFT RIGHT",
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:    "left-field",
+						Aliases: []string{"1"},
+						Usage:   "Join on field `N` of the left file.",
+						Value:   1,
+					},
+					&cli.IntFlag{
+						Name:    "right-field",
+						Aliases: []string{"2"},
+						Usage:   "Join on field `N` of the right file.",
+						Value:   1,
+					},
+					&cli.StringFlag{
+						Name:    "delimiter",
+						Aliases: []string{"d"},
+						Usage: "Delimiter for field separation in both files " +
+							"and in the output (use '\\t' for tab).",
+						Value: "\\t",
+					},
+					&cli.StringFlag{
+						Name:  "mode",
+						Value: "contains",
+						Usage: "Join condition (contains, overlap, equal). In " +
+							"contains mode, a right line is joined if its " +
+							"CIDR contains the left CIDR. In overlap mode, a " +
+							"right line is joined if its CIDR overlaps the " +
+							"left CIDR. In equal mode, the CIDRs must be " +
+							"identical. Default: contains.",
+						Action: validateJoinMode,
+					},
+					&cli.StringFlag{
+						Name:  "type",
+						Value: "inner",
+						Usage: "Join type (inner, left, anti). Inner joins " +
+							"print only joined lines. Left (outer) joins also " +
+							"print left lines with no match on their own. " +
+							"Anti joins print only the left lines with no " +
+							"match. Default: inner.",
+						Action: validateJoinType,
+					},
+				},
+				Action: handleJoin,
+			},
+			{
+				Name:  "which",
+				Usage: "Show which lists contain each CIDR",
+				Description: "Load many lists of CIDRs (via --list or " +
+					"--dir), and for each input line, append a column " +
+					"containing the comma-separated names of the lists " +
+					"which contain or overlap each selected field. In " +
+					"encompass mode, a list is shown for a range only if " +
+					"it contains the whole range.",
+				Aliases:   []string{"w"},
+				ArgsUsage: "[paths]",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:    "list",
+						Aliases: []string{"l"},
+						Usage: "Path to a CIDR list `FILE`, or a built-in " +
+							"named set (e.g. @rfc1918). May be provided " +
+							"multiple times. Lists are named by their file " +
+							"names, or by their full paths if several lists " +
+							"have the same file name.",
+						Action: validateListArgs,
+					},
+					&cli.StringSliceFlag{
+						Name:  "dir",
+						Usage: "Load every file in `DIR` as a CIDR list.",
+					},
+					&cli.StringFlag{
+						Name:  "mode",
+						Value: "overlap",
+						Usage: "Comparison strategy (overlap, encompass). In " +
+							"overlap mode, a list is shown if any of its " +
+							"CIDRs overlaps the input CIDR. In encompass " +
+							"mode, a list is shown only if it has a parent " +
+							"of the input CIDR. Default: overlap.",
+						Action: validateWhichMode,
+					},
+					&cli.IntSliceFlag{
+						Name:    "field",
+						Aliases: []string{"f"},
+						Usage: "Instruct cidrq to look for CIDRs in one or more " +
+							"fields, where field delimiter is provided via -d.",
+					},
+					&cli.StringFlag{
+						Name:    "delimiter",
+						Aliases: []string{"d"},
+						Usage: "Delimiter for field separation in input " +
+							"lines and the appended columns (use '\\t' for " +
+							"tab).",
+						Value: "\\t",
+					},
+					&cli.BoolFlag{
+						Name:    "url",
+						Aliases: []string{"u"},
+						Usage: "Accept a URL as valid if the hostname is a " +
+							"valid IP.",
+					},
+					&cli.BoolFlag{
+						Name:    "host",
+						Aliases: []string{"H"},
+						Usage: "Accept a host[:port] as valid if the host is " +
+							"a valid IP.",
+					},
+				},
+				Action: handleWhich,
+			},
+			{
+				Name:  "stats",
+				Usage: "Summarize lists of CIDRs",
+				Description: "Print statistics about the input CIDRs: the " +
+					"number of entries before and after compaction, the " +
+					"number of duplicate and redundant entries (those " +
+					"covered by another entry), and for each address " +
+					"family, the total number of addresses, the largest " +
+					"and smallest prefixes, and a histogram of prefix " +
+					"lengths.",
+				ArgsUsage: "[paths]",
+				Action:    handleStats,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Print statistics as JSON.",
+					},
+				},
+			},
+			{
+				Name:  "tree",
+				Usage: "Show the hierarchy of lists of CIDRs",
+				Description: "Print the input CIDRs in sorted order as an " +
+					"indented tree, with each CIDR nested under its closest " +
+					"enclosing CIDR. Nested CIDRs are marked as redundant, " +
+					"because an enclosing CIDR already covers them.",
+				ArgsUsage: "[paths]",
+				Action:    handleTree,
+			},
+			{
+				Name:  "expand",
+				Usage: "List the addresses in CIDRs",
+				Description: "Print every individual address in each input " +
+					"CIDR, one per line. Use --step or --sample to print " +
+					"only some of the addresses of large CIDRs.",
+				ArgsUsage: "[paths]",
+				Action:    handleExpand,
+				Flags: []cli.Flag{
+					&cli.Int64Flag{
+						Name: "max",
+						Usage: "Fail before printing more than `N` " +
+							"addresses in total. Use 0 for no limit.",
+						Value: 65536,
+					},
+					&cli.BoolFlag{
+						Name: "hosts",
+						Usage: "Skip the network and broadcast addresses of " +
+							"IPv4 CIDRs (except /31 and /32).",
+					},
+					&cli.Int64Flag{
+						Name:  "step",
+						Usage: "Print only every `N`th address of each CIDR.",
+						Value: 1,
+					},
+					&cli.Int64Flag{
+						Name: "sample",
+						Usage: "Print `N` randomly chosen addresses of each " +
+							"CIDR, in order.",
+					},
+				},
+			},
+			{
+				Name:  "split",
+				Usage: "Split CIDRs into fixed-size subnets",
+				Description: "Print every subnet of length --bits of each " +
+					"input CIDR, or split each input CIDR into --count equal " +
+					"parts. CIDRs that are already at least as long as the " +
+					"requested length are printed unchanged.",
+				ArgsUsage: "[paths]",
+				Action:    handleSplit,
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:    "bits",
+						Aliases: []string{"b"},
+						Usage:   "Split each CIDR into subnets of length `N`.",
+					},
+					&cli.Int64Flag{
+						Name:    "count",
+						Aliases: []string{"n"},
+						Usage: "Split each CIDR into `N` equal subnets. N " +
+							"must be a power of two.",
+					},
+					&cli.Int64Flag{
+						Name: "max",
+						Usage: "Fail before printing more than `N` " +
+							"subnets in total. Use 0 for no limit.",
+						Value: 65536,
+					},
+				},
+			},
+			{
+				Name:  "gaps",
+				Usage: "Find unused address space within CIDRs",
+				Description: "Print the parts of the --within CIDRs which " +
+					"are not covered by any input CIDR, as a compacted list " +
+					"of CIDRs. Use --bits to list only the free blocks of a " +
+					"given size.",
+				ArgsUsage: "[paths]",
+				Action:    handleGaps,
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name: "within",
+						Usage: "Comma-separated parent `CIDRS` in which to " +
+							"find unused address space.",
+						Required: true,
+					},
+					&cli.IntFlag{
+						Name:    "bits",
+						Aliases: []string{"b"},
+						Usage: "List every free subnet of length `N`, " +
+							"rather than the compacted free space.",
+					},
+					&cli.Int64Flag{
+						Name: "max",
+						Usage: "With --bits, fail before printing more than " +
+							"`N` subnets in total. Use 0 for no limit.",
+						Value: 65536,
+					},
+				},
+			},
+			{
+				Name:  "allocate",
+				Usage: "Allocate free subnets from a pool",
+				Description: "Print --count free CIDRs of length --bits from " +
+					"the CIDRs in the --pool list which do not overlap any " +
+					"CIDR in the --used list. Either all of the requested " +
+					"CIDRs are allocated, or none are.",
+				Action: handleAllocate,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name: "pool",
+						Usage: "Allocate from the CIDRs in `FILE` (or a " +
+							"named set, e.g. @rfc1918).",
+						Required:  true,
+						TakesFile: true,
+						Action: func(c *cli.Context, v string) error {
+							return validateListArgs(c, []string{v})
+						},
+					},
+					&cli.StringFlag{
+						Name: "used",
+						Usage: "Never allocate CIDRs overlapping those in " +
+							"`FILE`. With --append, a missing file is treated " +
+							"as empty and created.",
+						TakesFile: true,
+					},
+					&cli.IntFlag{
+						Name:     "bits",
+						Aliases:  []string{"b"},
+						Usage:    "Allocate CIDRs of length `N`.",
+						Required: true,
+					},
+					&cli.IntFlag{
+						Name:    "count",
+						Aliases: []string{"n"},
+						Usage:   "Allocate `N` CIDRs.",
+						Value:   1,
+					},
+					&cli.StringFlag{
+						Name: "strategy",
+						Usage: "Allocate from the first (lowest) free block " +
+							"that fits (first), or from the smallest one " +
+							"(best), which leaves larger blocks intact. One " +
+							"of: first, best.",
+						Value:  "first",
+						Action: validateAllocateStrategy,
+					},
+					&cli.IntFlag{
+						Name: "align",
+						Usage: "Start each allocated CIDR on a /`N` " +
+							"boundary, e.g. --bits 26 --align 24 allocates " +
+							"only the first /26 of each free /24.",
+					},
+					&cli.BoolFlag{
+						Name: "append",
+						Usage: "Append the allocated CIDRs to the --used " +
+							"file. The file is replaced atomically, and " +
+							"concurrent runs are serialized by locking a " +
+							"hidden .FILE.lock file next to it.",
+					},
+				},
+			},
+			{
+				Name:  "contains",
+				Usage: "Check whether addresses are in a set of CIDRs",
+				Description: "Exit with status 0 if every ADDR (an IP, CIDR " +
+					"or range) is in the set of CIDRs in SETFILE (or a " +
+					"named set, e.g. @rfc1918), and with status 1 " +
+					"otherwise. If no ADDRs are provided, they are read " +
+					"from stdin, one per line. If there are no ADDRs at " +
+					"all, the exit status is 1. Nothing is printed.",
+				ArgsUsage: "SETFILE [ADDR...]",
+				Action:    handleContains,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name: "any",
+						Usage: "Exit with status 0 if any ADDR is in the " +
+							"set, rather than all of them.",
+					},
+					&cli.StringFlag{
+						Name: "mode",
+						Usage: "How an ADDR must relate to the set to be in " +
+							"it. One of: overlap, encompass, cover, exact, " +
+							"contains, coverage:FRACTION (see filter " +
+							"--match-mode).",
+						Value:  "encompass",
+						Action: validateMatchMode,
+					},
+				},
+			},
 		},
 	}
+}
+
+func main() {
+	app := newApp()
 
 	cli.CommandHelpTemplate = `NAME
       {{template "helpNameTemplate" .}}
@@ -550,11 +2121,14 @@ OPTIONS{{range $i, $e := .VisibleFlags}}
 		cli.HelpPrinterCustom(w, templ, data, funcMap)
 	}
 
-	if err := app.Run(os.Args); err != nil {
+	err := app.Run(os.Args)
+	Logf("Done\n")
+	if errors.Is(err, errNoMatch) {
+		os.Exit(1)
+	} else if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
 	}
-
-	Logf("Done\n")
 }
 
 // Returns the placeholder, if any, and the unquoted usage string.
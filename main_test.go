@@ -0,0 +1,450 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// runCidrq runs cidrq with args, feeding it stdin, and returns what it wrote to
+// stdout and stderr along with the error which determines its exit status.
+func runCidrq(t *testing.T, stdin string, args ...string) (string, string, error) {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]*os.File{}
+	for _, name := range []string{"stdin", "stdout", "stderr"} {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files[name] = f
+	}
+	if _, err := files["stdin"].WriteString(stdin); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := files["stdin"].Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	oldStdin, oldStdout, oldStderr := os.Stdin, os.Stdout, os.Stderr
+	os.Stdin, os.Stdout, os.Stderr = files["stdin"], files["stdout"], files["stderr"]
+	combineOps = nil
+	err := newApp().Run(append([]string{"cidrq"}, args...))
+	os.Stdin, os.Stdout, os.Stderr = oldStdin, oldStdout, oldStderr
+
+	stdout, _ := os.ReadFile(files["stdout"].Name())
+	stderr, _ := os.ReadFile(files["stderr"].Name())
+	return string(stdout), string(stderr), err
+}
+
+// writeList writes lines to a new file and returns its path.
+func writeList(t *testing.T, lines ...string) string {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+// lines splits output into lines, without the trailing newline.
+func lines(output string) []string {
+	if output == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+}
+
+func TestFilterExcludeDoesNotAddEntries(t *testing.T) {
+	match := writeList(t, "10.0.0.0/8")
+	exclude := writeList(t, "10.9.0.0/16")
+	tests := []struct {
+		mode, input string
+	}{
+		{"exact", "10.10.0.0/15"},
+		{"contains", "10.8.0.0/14"},
+	}
+	for _, tt := range tests {
+		for _, args := range [][]string{
+			{"filter", "-m", match, "--match-mode", tt.mode},
+			{"filter", "-m", match, "-x", exclude, "--match-mode", tt.mode},
+		} {
+			stdout, _, err := runCidrq(t, tt.input+"\n", args...)
+			if stdout != "" || err != errNoMatch {
+				t.Errorf("%v with input %s: printed %q, err %v; want no match",
+					args, tt.input, stdout, err)
+			}
+		}
+	}
+}
+
+func TestCleanRangeField(t *testing.T) {
+	match := writeList(t, "10.0.0.0/8")
+	table := writeList(t, "10.0.0.0/8,internal")
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{
+			[]string{"filter", "-d", ",", "-f", "2", "-m", match, "--clean"},
+			"a,10.0.0.5-10.0.0.10,x",
+		},
+		{
+			[]string{"lookup", "-d", ",", "-f", "2", "-t", table, "--clean"},
+			"a,10.0.0.5-10.0.0.10,x,internal",
+		},
+		{
+			[]string{"filter", "-d", ",", "-f", "2", "-m", match, "--clean", "--ranges"},
+			"a,10.0.0.5-10.0.0.10,x",
+		},
+	}
+	for _, tt := range tests {
+		stdout, _, err := runCidrq(t, "a,10.0.0.5 - 10.0.0.10,x\n", tt.args...)
+		if err != nil || stdout != tt.want+"\n" {
+			t.Errorf("%v = %q, %v; want %q", tt.args, stdout, err, tt.want)
+		}
+	}
+}
+
+func TestJoinRangeField(t *testing.T) {
+	left := writeList(t, "10.0.0.0/24\tL1", "10.0.0.5-10.0.0.10\tL2")
+	right := writeList(t,
+		"10.0.0.5-10.0.0.10\tR1", "10.0.0.0/24\tR2", "10.0.0.8/30\tR3")
+	tests := []struct {
+		mode string
+		want []string
+	}{
+		{"contains", []string{
+			"10.0.0.0/24\tL1\t10.0.0.0/24\tR2",
+			"10.0.0.5-10.0.0.10\tL2\t10.0.0.0/24\tR2",
+			"10.0.0.5-10.0.0.10\tL2\t10.0.0.5-10.0.0.10\tR1",
+		}},
+		{"overlap", []string{
+			"10.0.0.0/24\tL1\t10.0.0.0/24\tR2",
+			"10.0.0.0/24\tL1\t10.0.0.8/30\tR3",
+			"10.0.0.0/24\tL1\t10.0.0.5-10.0.0.10\tR1",
+			"10.0.0.5-10.0.0.10\tL2\t10.0.0.0/24\tR2",
+			"10.0.0.5-10.0.0.10\tL2\t10.0.0.8/30\tR3",
+			"10.0.0.5-10.0.0.10\tL2\t10.0.0.5-10.0.0.10\tR1",
+		}},
+		{"equal", []string{
+			"10.0.0.0/24\tL1\t10.0.0.0/24\tR2",
+			"10.0.0.5-10.0.0.10\tL2\t10.0.0.5-10.0.0.10\tR1",
+		}},
+	}
+	for _, tt := range tests {
+		stdout, _, err := runCidrq(t, "", "join", "--mode", tt.mode, left, right)
+		if err != nil || !slices.Equal(lines(stdout), tt.want) {
+			t.Errorf("join --mode %s = %q, %v; want %q", tt.mode, lines(stdout), err, tt.want)
+		}
+	}
+}
+
+func TestFilterIsGlobal(t *testing.T) {
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{"8.8.8.8", true},
+		{"8.0.0.0/7", true},
+		{"8.0.0.0/5", false},
+		{"10.0.0.1", false},
+		{"128.0.0.0/1", false},
+		{"2001:db8::/32", true},
+		{"fd00::1", false},
+		{"::/1", false},
+	}
+	for _, tt := range tests {
+		stdout, _, err := runCidrq(t, tt.input+"\n", "filter", "--is", "global")
+		if got := stdout != ""; got != tt.want || (err == nil) != tt.want {
+			t.Errorf("filter --is global with %s: printed %q, err %v; want pass %v",
+				tt.input, stdout, err, tt.want)
+		}
+	}
+}
+
+func TestAllocateAppendCreatesUsed(t *testing.T) {
+	pool := writeList(t, "10.0.0.0/24")
+	used := filepath.Join(t.TempDir(), "used.txt")
+	for _, want := range []string{"10.0.0.0/26", "10.0.0.64/26"} {
+		stdout, _, err := runCidrq(t, "",
+			"allocate", "--pool", pool, "--used", used, "--bits", "26", "--append")
+		if err != nil || stdout != want+"\n" {
+			t.Fatalf("allocate --append = %q, %v; want %s", stdout, err, want)
+		}
+	}
+	contents, err := os.ReadFile(used)
+	if err != nil || string(contents) != "10.0.0.0/26\n10.0.0.64/26\n" {
+		t.Errorf("used file = %q, %v", contents, err)
+	}
+
+	// Without --append, the used file must exist
+	missing := filepath.Join(t.TempDir(), "missing.txt")
+	if _, _, err = runCidrq(t, "",
+		"allocate", "--pool", pool, "--used", missing, "--bits", "26"); err == nil {
+		t.Errorf("allocate with missing --used succeeded, want error")
+	}
+}
+
+// filterTest is a filter invocation and the lines it should print.
+type filterTest struct {
+	args  []string
+	input string
+	want  []string
+}
+
+func runFilterTests(t *testing.T, tests []filterTest) {
+	t.Helper()
+	for _, tt := range tests {
+		args := append([]string{"filter"}, tt.args...)
+		stdout, _, err := runCidrq(t, tt.input+"\n", args...)
+		if (err == nil) != (len(tt.want) > 0) || !slices.Equal(lines(stdout), tt.want) {
+			t.Errorf("%v with input %q = %q, %v; want %q",
+				tt.args, tt.input, lines(stdout), err, tt.want)
+		}
+	}
+}
+
+func TestFilterPerFieldLists(t *testing.T) {
+	match := writeList(t, "10.0.0.0/8")
+	match2 := writeList(t, "192.168.0.0/16")
+	exclude2 := writeList(t, "192.168.5.0/24")
+	exclude := writeList(t, "192.168.1.0/24")
+	args := []string{"-d", ",", "-f", "1", "-m", match, "-m", "2=" + match2, "-x", "2=" + exclude2}
+	runFilterTests(t, []filterTest{
+		// Field 2 is checked against its own lists only
+		{args, "10.1.1.1,192.168.1.1", []string{"10.1.1.1,192.168.1.1"}},
+		{args, "10.1.1.1,10.2.2.2", nil},
+		// Field 2 passing does not make up for field 1
+		{args, "8.8.8.8,192.168.1.1", nil},
+		// A field's own exclude list applies only to that field
+		{args, "10.1.1.1,192.168.5.5", nil},
+		{args, "10.1.1.1,192.168.4.4", []string{"10.1.1.1,192.168.4.4"}},
+		// ...so field 1 may hold an address in field 2's exclude list
+		{
+			[]string{"-d", ",", "-f", "1", "--match-cidr", "192.168.5.0/24",
+				"-m", "2=" + match2, "-x", "2=" + exclude2},
+			"192.168.5.5,192.168.4.4",
+			[]string{"192.168.5.5,192.168.4.4"},
+		},
+		// Default exclude lists also apply to fields with their own lists
+		{append(slices.Clone(args), "-x", exclude), "10.1.1.1,192.168.1.1", nil},
+	})
+}
+
+func TestFilterRequire(t *testing.T) {
+	match := writeList(t, "10.0.0.0/8")
+	match3 := writeList(t, "192.168.0.0/16")
+	anyArgs := []string{"-d", ",", "-f", "1", "-f", "2", "-m", match}
+	allArgs := append(slices.Clone(anyArgs), "--require", "all")
+	runFilterTests(t, []filterTest{
+		{anyArgs, "10.0.0.1,8.8.8.8", []string{"10.0.0.1,8.8.8.8"}},
+		{allArgs, "10.0.0.1,8.8.8.8", nil},
+		{anyArgs, "10.0.0.1,10.0.0.2", []string{"10.0.0.1,10.0.0.2"}},
+		{allArgs, "10.0.0.1,10.0.0.2", []string{"10.0.0.1,10.0.0.2"}},
+		{anyArgs, "8.8.8.8,1.1.1.1", nil},
+		{allArgs, "8.8.8.8,1.1.1.1", nil},
+		// A range field passes or fails as a whole
+		{anyArgs, "9.255.255.255-10.0.0.1,8.8.8.8", []string{"9.255.255.255-10.0.0.1,8.8.8.8"}},
+		{
+			append(slices.Clone(anyArgs), "--match-mode", "encompass"),
+			"9.255.255.255-10.0.0.1,8.8.8.8",
+			nil,
+		},
+		// A field with its own lists must always pass
+		{
+			append(slices.Clone(anyArgs), "-m", "3="+match3),
+			"10.0.0.1,8.8.8.8,192.168.0.1",
+			[]string{"10.0.0.1,8.8.8.8,192.168.0.1"},
+		},
+		{append(slices.Clone(anyArgs), "-m", "3="+match3), "10.0.0.1,8.8.8.8,8.8.4.4", nil},
+		{append(slices.Clone(allArgs), "-m", "3="+match3), "10.0.0.1,8.8.8.8,192.168.0.1", nil},
+	})
+}
+
+func TestFilterInvertFlat(t *testing.T) {
+	match := writeList(t, "10.0.0.0/8")
+	args := []string{"-d", ",", "-f", "1", "-f", "2", "-m", match, "--invert"}
+	flatArgs := append(slices.Clone(args), "--flat")
+	allArgs := append(slices.Clone(flatArgs), "--require", "all")
+	runFilterTests(t, []filterTest{
+		{args, "10.0.0.1,8.8.8.8", nil},
+		{args, "8.8.8.8,1.1.1.1", []string{"8.8.8.8,1.1.1.1"}},
+		// In flat mode, only the fields which failed are printed, and only
+		// from lines which failed
+		{flatArgs, "10.0.0.1,8.8.8.8", nil},
+		{flatArgs, "8.8.8.8,1.1.1.1", []string{"8.8.8.8", "1.1.1.1"}},
+		{allArgs, "10.0.0.1,8.8.8.8", []string{"8.8.8.8"}},
+		{allArgs, "10.0.0.1,10.0.0.2", nil},
+		// A range is printed once, as a unit (or as its CIDRs, with --clean)
+		{
+			append(slices.Clone(allArgs), "--match-mode", "encompass"),
+			"10.0.0.1,9.255.255.254-10.0.0.1",
+			[]string{"9.255.255.254-10.0.0.1"},
+		},
+		{
+			append(slices.Clone(allArgs), "--match-mode", "encompass", "--clean"),
+			"10.0.0.1,9.255.255.254-10.0.0.1",
+			[]string{"9.255.255.254/31", "10.0.0.0/31"},
+		},
+	})
+}
+
+func TestFilterExplain(t *testing.T) {
+	match := writeList(t, "10.0.0.0/8")
+	exclude := writeList(t, "10.9.0.0/16")
+	args := []string{
+		"filter", "-d", ",", "-f", "1", "-f", "2", "-m", match, "-x", exclude, "--explain",
+	}
+	tests := []struct {
+		extra []string
+		input string
+		want  []string
+	}{
+		// Without --flat, every field gets its line's verdict
+		{nil, "10.0.0.1,8.8.8.8", []string{
+			"10.0.0.1\tpass\tmatch=10.0.0.0/8\texclude=-",
+			"8.8.8.8\tpass\tmatch=-\texclude=-",
+		}},
+		{nil, "10.9.0.1,8.8.8.8", []string{
+			"10.9.0.1\tdrop\tmatch=10.0.0.0/8\texclude=10.9.0.0/16",
+			"8.8.8.8\tdrop\tmatch=-\texclude=-",
+		}},
+		{[]string{"--flat"}, "10.0.0.1,8.8.8.8", []string{
+			"10.0.0.1\tpass\tmatch=10.0.0.0/8\texclude=-",
+			"8.8.8.8\tdrop\tmatch=-\texclude=-",
+		}},
+		{[]string{"--require", "all"}, "10.0.0.1,8.8.8.8", []string{
+			"10.0.0.1\tdrop\tmatch=10.0.0.0/8\texclude=-",
+			"8.8.8.8\tdrop\tmatch=-\texclude=-",
+		}},
+		{[]string{"--invert", "--flat"}, "8.8.8.8,10.9.0.1", []string{
+			"8.8.8.8\tpass\tmatch=-\texclude=-",
+			"10.9.0.1\tpass\tmatch=10.0.0.0/8\texclude=10.9.0.0/16",
+		}},
+		// A range gets a single verdict
+		{nil, "10.8.255.255-10.9.0.1,8.8.8.8", []string{
+			"10.8.255.255-10.9.0.1\tpass\tmatch=10.0.0.0/8\texclude=10.9.0.0/16",
+			"8.8.8.8\tpass\tmatch=-\texclude=-",
+		}},
+	}
+	for _, tt := range tests {
+		_, stderr, _ := runCidrq(t, tt.input+"\n", append(slices.Clone(args), tt.extra...)...)
+		if !slices.Equal(lines(stderr), tt.want) {
+			t.Errorf("%v with input %q explained %q, want %q",
+				tt.extra, tt.input, lines(stderr), tt.want)
+		}
+	}
+}
+
+// countTest is an invocation of a command and the number of lines it should
+// print, or -1 if it should fail.
+type countTest struct {
+	args  []string
+	input string
+	want  int
+}
+
+func runCountTests(t *testing.T, tests []countTest) {
+	t.Helper()
+	for _, tt := range tests {
+		stdout, _, err := runCidrq(t, tt.input+"\n", tt.args...)
+		if tt.want < 0 {
+			if err == nil {
+				t.Errorf("%v with input %q succeeded, want error", tt.args, tt.input)
+			}
+		} else if err != nil || len(lines(stdout)) != tt.want {
+			t.Errorf("%v with input %q printed %d lines, %v; want %d",
+				tt.args, tt.input, len(lines(stdout)), err, tt.want)
+		}
+	}
+}
+
+func TestExpandCounts(t *testing.T) {
+	runCountTests(t, []countTest{
+		{[]string{"expand"}, "10.0.0.0/30", 4},
+		{[]string{"expand"}, "10.0.0.5", 1},
+		{[]string{"expand"}, "10.0.0.0-10.0.0.5", 6},
+		{[]string{"expand"}, "2001:db8::/120", 256},
+		{[]string{"expand", "--hosts"}, "10.0.0.0/29", 6},
+		{[]string{"expand", "--hosts"}, "10.0.0.0/31", 2},
+		{[]string{"expand", "--hosts"}, "2001:db8::/126", 4},
+		{[]string{"expand", "--step", "64"}, "10.0.0.0/24", 4},
+		{[]string{"expand", "--sample", "5"}, "10.0.0.0/24", 5},
+		{[]string{"expand", "--sample", "500"}, "10.0.0.0/24", 256},
+		{[]string{"expand", "--max", "300"}, "10.0.0.0/24\n10.0.0.0/30", 260},
+		{[]string{"expand", "--max", "300"}, "10.0.0.0/24\n10.0.1.0/24", -1},
+		{[]string{"expand", "--max", "0"}, "10.0.0.0/15", 131072},
+	})
+}
+
+func TestSplitCounts(t *testing.T) {
+	runCountTests(t, []countTest{
+		{[]string{"split", "-b", "26"}, "10.0.0.0/24", 4},
+		{[]string{"split", "-b", "26"}, "10.0.0.0/24\n10.0.1.0/25", 6},
+		{[]string{"split", "-n", "8"}, "10.0.0.0/24", 8},
+		{[]string{"split", "-n", "1"}, "10.0.0.0/24", 1},
+		{[]string{"split", "-b", "24"}, "10.0.0.0/28", 1},
+		{[]string{"split", "-b", "64"}, "2001:db8::/56", 256},
+		{[]string{"split", "-b", "33"}, "10.0.0.0/24", -1},
+		{[]string{"split", "-n", "3"}, "10.0.0.0/24", -1},
+		{[]string{"split", "-n", "512"}, "10.0.0.0/24", -1},
+		{[]string{"split"}, "10.0.0.0/24", -1},
+		{[]string{"split", "-b", "32"}, "10.0.0.0/16", 65536},
+		{[]string{"split", "-b", "32"}, "10.0.0.0/16\n10.1.0.0/32", 65537},
+		{[]string{"split", "-b", "32"}, "10.0.0.0/16\n10.1.0.0/31", -1},
+		{[]string{"split", "-b", "32", "--max", "0"}, "10.0.0.0/15", 131072},
+	})
+}
+
+func TestGapsCounts(t *testing.T) {
+	used := "10.0.0.0/26\n10.0.0.128/27"
+	runCountTests(t, []countTest{
+		// 10.0.0.64/26, 10.0.0.160/27 and 10.0.0.192/26
+		{[]string{"gaps", "--within", "10.0.0.0/24"}, used, 3},
+		{[]string{"gaps", "--within", "10.0.0.0/24", "-b", "27"}, used, 5},
+		{[]string{"gaps", "--within", "10.0.0.0/24", "-b", "25"}, used, 0},
+		{[]string{"gaps", "--within", "10.0.0.0/24,10.1.0.0/30", "-b", "30"}, used, 41},
+		{[]string{"gaps", "--within", "10.0.0.0/24"}, "10.0.0.0/24", 0},
+		{[]string{"gaps", "--within", "10.0.0.0/24"}, "10.0.0.0/16", 0},
+		{[]string{"gaps", "--within", "10.0.0.0/24"}, "192.168.0.0/16", 1},
+		{[]string{"gaps", "--within", "10.0.0.0/24", "-b", "30", "--max", "10"}, used, -1},
+		{[]string{"gaps", "--within", "10.0.0.0/14", "-b", "32", "--max", "0"}, "10.0.0.0/15", 131072},
+	})
+}
+
+func TestCombineSubtract(t *testing.T) {
+	tests := []struct {
+		input, subtract, want []string
+	}{
+		{
+			[]string{"10.0.0.0/24", "10.1.0.0/26"},
+			[]string{"10.0.0.0/26", "10.0.0.128/27"},
+			[]string{"10.0.0.64/26", "10.0.0.160/27", "10.0.0.192/26", "10.1.0.0/26"},
+		},
+		{
+			[]string{"10.0.0.0/21", "10.0.0.0/23", "10.0.2.128/25", "10.0.3.216/29"},
+			[]string{"10.0.3.170/31"},
+			[]string{
+				"10.0.0.0/23", "10.0.2.0/24", "10.0.3.0/25", "10.0.3.128/27",
+				"10.0.3.160/29", "10.0.3.168/31", "10.0.3.172/30", "10.0.3.176/28",
+				"10.0.3.192/26", "10.0.4.0/22",
+			},
+		},
+		{[]string{"10.0.0.0/24"}, []string{"10.0.0.0/16"}, nil},
+	}
+	for _, tt := range tests {
+		subtract := writeList(t, tt.subtract...)
+		stdout, _, err := runCidrq(t, strings.Join(tt.input, "\n")+"\n", "combine", "-s", subtract)
+		if err != nil || !slices.Equal(lines(stdout), tt.want) {
+			t.Errorf("%v minus %v = %q, %v; want %q", tt.input, tt.subtract, lines(stdout), err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+// namedSets maps the names that may be given as "@name" in place of a list file
+// to the CIDRs they represent. The CIDRs are drawn from the IANA IPv4 and IPv6
+// Special-Purpose Address Registries (RFC 6890).
+var namedSets = map[string][]string{
+	"rfc1918": {
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+	},
+	"loopback": {
+		"127.0.0.0/8",
+		"::1/128",
+	},
+	"linklocal": {
+		"169.254.0.0/16",
+		"fe80::/10",
+	},
+	"multicast": {
+		"224.0.0.0/4",
+		"ff00::/8",
+	},
+	"documentation": {
+		"192.0.2.0/24",
+		"198.51.100.0/24",
+		"203.0.113.0/24",
+		"2001:db8::/32",
+		"3fff::/20",
+	},
+	"cgnat": {
+		"100.64.0.0/10",
+	},
+	"bogons": {
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.0.0.0/24",
+		"192.0.2.0/24",
+		"192.168.0.0/16",
+		"198.18.0.0/15",
+		"198.51.100.0/24",
+		"203.0.113.0/24",
+		"224.0.0.0/4",
+		"240.0.0.0/4",
+		"::/128",
+		"::1/128",
+		"::ffff:0:0/96",
+		"100::/64",
+		"2001:db8::/32",
+		"3fff::/20",
+		"fc00::/7",
+		"fe80::/10",
+		"fec0::/10",
+		"ff00::/8",
+	},
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// AddrRange is an inclusive range of IP addresses of the same family.
+type AddrRange struct {
+	First netip.Addr
+	Last  netip.Addr
+}
+
+// String returns the range in the form "first-last", or just the address if
+// the range contains a single address.
+func (r AddrRange) String() string {
+	if r.First == r.Last {
+		return r.First.String()
+	}
+	return r.First.String() + "-" + r.Last.String()
+}
+
+// Prefixes returns the minimal set of Prefixes covering exactly r, in order.
+func (r AddrRange) Prefixes() []netip.Prefix {
+	prefixes := []netip.Prefix{}
+	first := r.First
+	for {
+		// Find the shortest prefix starting at first which ends before r.Last
+		bits := first.BitLen()
+		for bits > 0 {
+			p := netip.PrefixFrom(first, bits-1)
+			if p.Masked().Addr() != first || LastAddr(p).Compare(r.Last) > 0 {
+				break
+			}
+			bits--
+		}
+		p := netip.PrefixFrom(first, bits)
+		prefixes = append(prefixes, p)
+		last := LastAddr(p)
+		if last == r.Last {
+			return prefixes
+		}
+		first = last.Next()
+	}
+}
+
+// ParseRange parses a string of the form "first-last" as an AddrRange. Spaces
+// around the '-' are allowed.
+func ParseRange(s string) (AddrRange, error) {
+	firstStr, lastStr, found := strings.Cut(s, "-")
+	if !found {
+		return AddrRange{}, fmt.Errorf("Invalid range: '%s'", s)
+	}
+	first, err := netip.ParseAddr(strings.TrimSpace(firstStr))
+	if err != nil {
+		return AddrRange{}, err
+	}
+	last, err := netip.ParseAddr(strings.TrimSpace(lastStr))
+	if err != nil {
+		return AddrRange{}, err
+	}
+	if first.Is4() != last.Is4() || first.Compare(last) > 0 {
+		return AddrRange{}, fmt.Errorf("Invalid range: '%s'", s)
+	}
+	return AddrRange{first, last}, nil
+}
+
+// PrefixRanges converts sorted, non-overlapping Prefixes into ranges, merging
+// adjacent Prefixes into a single range.
+func PrefixRanges(prefixes []netip.Prefix) []AddrRange {
+	ranges := []AddrRange{}
+	for _, p := range prefixes {
+		first, last := p.Masked().Addr(), LastAddr(p)
+		if n := len(ranges); n > 0 && ranges[n-1].Last.Next() == first {
+			ranges[n-1].Last = last
+		} else {
+			ranges = append(ranges, AddrRange{first, last})
+		}
+	}
+	return ranges
+}
+
+// StringRanges returns sorted, non-overlapping Prefixes as comma-separated
+// ranges.
+func StringRanges(prefixes []netip.Prefix) string {
+	strs := []string{}
+	for _, r := range PrefixRanges(prefixes) {
+		strs = append(strs, r.String())
+	}
+	return strings.Join(strs, ",")
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math/rand"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestAddrRangePrefixes(t *testing.T) {
+	tests := []struct {
+		r    string
+		want []string
+	}{
+		{"10.0.0.0-10.0.0.255", []string{"10.0.0.0/24"}},
+		{"10.0.0.5-10.0.0.5", []string{"10.0.0.5/32"}},
+		{"10.0.0.5-10.0.0.9", []string{"10.0.0.5/32", "10.0.0.6/31", "10.0.0.8/31"}},
+		{"10.0.0.255-10.0.1.0", []string{"10.0.0.255/32", "10.0.1.0/32"}},
+		{"0.0.0.0-255.255.255.255", []string{"0.0.0.0/0"}},
+		{"::1-::ff", []string{
+			"::1/128", "::2/127", "::4/126", "::8/125",
+			"::10/124", "::20/123", "::40/122", "::80/121",
+		}},
+	}
+	for _, tt := range tests {
+		r, err := ParseRange(tt.r)
+		if err != nil {
+			t.Fatalf("ParseRange(%s): %v", tt.r, err)
+		}
+		got := []string{}
+		for _, p := range r.Prefixes() {
+			got = append(got, p.String())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s.Prefixes() = %v, want %v", tt.r, got, tt.want)
+		}
+	}
+
+	// Check random ranges address by address, and that no two consecutive
+	// Prefixes could have been merged into one
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		a := netip.AddrFrom4([4]byte{10, 0, 0, byte(rng.Intn(256))})
+		b := netip.AddrFrom4([4]byte{10, 0, 0, byte(rng.Intn(256))})
+		if a.Compare(b) > 0 {
+			a, b = b, a
+		}
+		r := AddrRange{a, b}
+		prefixes := r.Prefixes()
+		got := addrSet(prefixes...)
+		want := int(b.As4()[3]) - int(a.As4()[3]) + 1
+		if len(got) != want {
+			t.Fatalf("%s.Prefixes() = %v covers %d addresses, want %d",
+				r, prefixes, len(got), want)
+		}
+		for addr := range got {
+			if addr.Compare(a) < 0 || addr.Compare(b) > 0 {
+				t.Fatalf("%s.Prefixes() = %v covers %s", r, prefixes, addr)
+			}
+		}
+		for j := 1; j < len(prefixes); j++ {
+			if LastAddr(prefixes[j-1]).Next() != prefixes[j].Addr() {
+				t.Fatalf("%s.Prefixes() = %v is not contiguous", r, prefixes)
+			}
+			p, q := prefixes[j-1], prefixes[j]
+			parent := netip.PrefixFrom(p.Addr(), p.Bits()-1).Masked()
+			if p.Bits() == q.Bits() && parent.Contains(q.Addr()) {
+				t.Fatalf("%s.Prefixes() = %v is not minimal", r, prefixes)
+			}
+		}
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	for _, s := range []string{"10.0.0.1 - 10.0.0.9", "::1-::2"} {
+		if _, err := ParseRange(s); err != nil {
+			t.Errorf("ParseRange(%q): %v", s, err)
+		}
+	}
+	for _, s := range []string{"10.0.0.9-10.0.0.1", "10.0.0.1-::1", "10.0.0.1-", "x-y"} {
+		if _, err := ParseRange(s); err == nil {
+			t.Errorf("ParseRange(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestPrefixSetMembershipFnRange(t *testing.T) {
+	set := prefixSetOf(mustParsePrefixes("10.0.0.0/8", "9.255.255.255")...)
+	tests := []struct {
+		mode string
+		r    string
+		want bool
+	}{
+		{"overlap", "9.255.255.250-10.0.0.3", true},
+		{"encompass", "9.255.255.250-10.0.0.3", false},
+		{"encompass", "10.0.0.1-10.0.0.9", true},
+		{"cover", "9.255.255.252-10.0.0.3", false},
+		{"cover", "9.255.255.255-10.0.0.3", true},
+		{"exact", "9.255.255.255-9.255.255.255", true},
+		{"contains", "9.255.255.250-9.255.255.255", true},
+		{"contains", "10.0.0.1-10.0.0.9", false},
+		{"coverage:0.5", "9.255.255.252-10.0.0.3", true},
+		{"coverage:0.5", "9.255.255.249-10.0.0.3", false},
+	}
+	for _, tt := range tests {
+		r, err := ParseRange(tt.r)
+		if err != nil {
+			t.Fatalf("ParseRange(%s): %v", tt.r, err)
+		}
+		if got := prefixSetMembershipFn(tt.mode)(set, r.Prefixes()); got != tt.want {
+			t.Errorf("%s membership of %s = %v, want %v", tt.mode, tt.r, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"net/netip"
+	"slices"
+
+	"github.com/aromatt/netipds"
+)
+
+// familyStats summarizes the prefixes of one address family.
+type familyStats struct {
+	Entries       int         `json:"entries"`
+	Compacted     int         `json:"compacted"`
+	Addresses     string      `json:"addresses"`
+	Largest       string      `json:"largest,omitempty"`
+	Smallest      string      `json:"smallest,omitempty"`
+	PrefixLengths map[int]int `json:"prefix_lengths"`
+
+	largest, smallest netip.Prefix
+}
+
+// prefixStats summarizes a list of prefixes, before and after compaction.
+type prefixStats struct {
+	Entries    int          `json:"entries"`
+	Duplicates int          `json:"duplicates"`
+	Redundant  int          `json:"redundant"`
+	Compacted  int          `json:"compacted"`
+	IPv4       *familyStats `json:"ipv4"`
+	IPv6       *familyStats `json:"ipv6"`
+
+	psb netipds.PrefixSetBuilder
+}
+
+func newPrefixStats() *prefixStats {
+	return &prefixStats{
+		IPv4: &familyStats{PrefixLengths: map[int]int{}},
+		IPv6: &familyStats{PrefixLengths: map[int]int{}},
+	}
+}
+
+func (s *prefixStats) family(p netip.Prefix) *familyStats {
+	if p.Addr().Is4() {
+		return s.IPv4
+	}
+	return s.IPv6
+}
+
+// Add adds an input entry to s.
+func (s *prefixStats) Add(p netip.Prefix) {
+	p = p.Masked()
+	s.psb.Add(p)
+	s.Entries++
+	f := s.family(p)
+	f.Entries++
+	f.PrefixLengths[p.Bits()]++
+	if !f.largest.IsValid() || p.Bits() < f.largest.Bits() {
+		f.largest = p
+	}
+	if !f.smallest.IsValid() || p.Bits() > f.smallest.Bits() {
+		f.smallest = p
+	}
+}
+
+// Finish computes the statistics which depend on the compacted set of all
+// entries added to s.
+func (s *prefixStats) Finish() {
+	ps := s.psb.PrefixSet()
+	compact := ps.PrefixesCompact()
+	s.Duplicates = s.Entries - ps.Size()
+	s.Redundant = ps.Size() - len(compact)
+	s.Compacted = len(compact)
+
+	addresses := map[*familyStats]*big.Int{s.IPv4: big.NewInt(0), s.IPv6: big.NewInt(0)}
+	for _, p := range compact {
+		f := s.family(p)
+		f.Compacted++
+		addresses[f].Add(addresses[f], PrefixSize(p))
+	}
+	for f, n := range addresses {
+		f.Addresses = n.String()
+		if f.largest.IsValid() {
+			f.Largest = StringMaybeAddr(f.largest)
+			f.Smallest = StringMaybeAddr(f.smallest)
+		}
+	}
+}
+
+// Print writes a human-readable summary of s to w.
+func (s *prefixStats) Print(w io.Writer) {
+	fmt.Fprintf(w, "Entries:             %d\n", s.Entries)
+	fmt.Fprintf(w, "Duplicate entries:   %d\n", s.Duplicates)
+	fmt.Fprintf(w, "Redundant entries:   %d\n", s.Redundant)
+	fmt.Fprintf(w, "Compacted prefixes:  %d\n", s.Compacted)
+	for _, fam := range []struct {
+		name string
+		f    *familyStats
+	}{{"IPv4", s.IPv4}, {"IPv6", s.IPv6}} {
+		if fam.f.Entries == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s\n", fam.name)
+		fmt.Fprintf(w, "  Entries:            %d\n", fam.f.Entries)
+		fmt.Fprintf(w, "  Compacted prefixes: %d\n", fam.f.Compacted)
+		fmt.Fprintf(w, "  Addresses:          %s\n", fam.f.Addresses)
+		fmt.Fprintf(w, "  Largest prefix:     %s\n", fam.f.Largest)
+		fmt.Fprintf(w, "  Smallest prefix:    %s\n", fam.f.Smallest)
+		fmt.Fprintf(w, "  Prefix lengths:\n")
+		lengths := make([]int, 0, len(fam.f.PrefixLengths))
+		for bits := range fam.f.PrefixLengths {
+			lengths = append(lengths, bits)
+		}
+		slices.Sort(lengths)
+		for _, bits := range lengths {
+			fmt.Fprintf(w, "    /%-4d %d\n", bits, fam.f.PrefixLengths[bits])
+		}
+	}
+}
@@ -2,10 +2,17 @@ package main
 
 import (
 	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"math/big"
 	"net"
 	"net/netip"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/aromatt/netipds"
 )
@@ -38,6 +45,14 @@ func EnsurePrefix(s string) string {
 	return s + "/32"
 }
 
+// UnescapeDelimiter converts the escaped tab delimiter '\t' into a tab.
+func UnescapeDelimiter(delimiter string) string {
+	if delimiter == "\\t" {
+		return "\t"
+	}
+	return delimiter
+}
+
 // StringMaybeAddr returns the Prefix as a string, stripping the prefix length
 // if the Prefix is a single IP.
 func StringMaybeAddr(p netip.Prefix) string {
@@ -47,6 +62,137 @@ func StringMaybeAddr(p netip.Prefix) string {
 	return p.String()
 }
 
+// LastAddr returns the last (highest) address in p.
+func LastAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	a, _ := netip.AddrFromSlice(b)
+	return a
+}
+
+// PrefixSize returns the number of addresses in p.
+func PrefixSize(p netip.Prefix) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(p.Addr().BitLen()-p.Bits()))
+}
+
+// AddrAdd returns the address n addresses after a. The second return value is
+// false if the result would overflow a's address family.
+func AddrAdd(a netip.Addr, n *big.Int) (netip.Addr, bool) {
+	b := a.AsSlice()
+	sum := new(big.Int).Add(new(big.Int).SetBytes(b), n)
+	if sum.Sign() < 0 || sum.BitLen() > len(b)*8 {
+		return netip.Addr{}, false
+	}
+	return netip.AddrFromSlice(sum.FillBytes(b))
+}
+
+// SplitPrefix returns the two halves of p. The caller must ensure that p is
+// not a single IP.
+func SplitPrefix(p netip.Prefix) (netip.Prefix, netip.Prefix) {
+	lo := netip.PrefixFrom(p.Masked().Addr(), p.Bits()+1)
+	hi := netip.PrefixFrom(LastAddr(lo).Next(), p.Bits()+1)
+	return lo, hi
+}
+
+// EachSubnet calls fn on each subnet of p of length bits, in order. If p is
+// already at least that long, fn is called on p alone.
+func EachSubnet(p netip.Prefix, bits int, fn func(netip.Prefix)) {
+	p = p.Masked()
+	if bits <= p.Bits() {
+		fn(p)
+		return
+	}
+	last := LastAddr(p)
+	for sub := netip.PrefixFrom(p.Addr(), bits); ; {
+		fn(sub)
+		subLast := LastAddr(sub)
+		if subLast == last {
+			return
+		}
+		sub = netip.PrefixFrom(subLast.Next(), bits)
+	}
+}
+
+// PrefixSetCovers returns true if p is completely covered by the union of the
+// Prefixes in ps, even if no single Prefix in ps encompasses p.
+func PrefixSetCovers(ps *netipds.PrefixSet, p netip.Prefix) bool {
+	if ps.Encompasses(p) {
+		return true
+	}
+	if p.Bits() == p.Addr().BitLen() || !ps.OverlapsPrefix(p) {
+		return false
+	}
+	lo, hi := SplitPrefix(p)
+	return PrefixSetCovers(ps, lo) && PrefixSetCovers(ps, hi)
+}
+
+// PrefixSetCoverage returns the fraction of the addresses in prefixes that are
+// covered by the union of the Prefixes in ps. The provided Prefixes must not
+// overlap each other (e.g. the Prefixes of a range).
+func PrefixSetCoverage(ps *netipds.PrefixSet, prefixes ...netip.Prefix) float64 {
+	covered, total := 0.0, 0.0
+	for _, p := range prefixes {
+		size := math.Ldexp(1, -p.Bits())
+		total += size
+		if ps.Encompasses(p) {
+			covered += size
+			continue
+		}
+		for _, d := range ps.DescendantsOf(p.Masked()).PrefixesCompact() {
+			covered += math.Ldexp(1, -d.Bits())
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return covered / total
+}
+
+// PrefixSetBuilderSubtract removes every address in ps from psb, leaving behind
+// any remaining portions of affected Prefixes. Each Prefix of psb which is
+// partially covered by ps is split in half until every piece is either
+// completely covered by ps (and dropped) or does not overlap ps at all.
+func PrefixSetBuilderSubtract(psb *netipds.PrefixSetBuilder, ps *netipds.PrefixSet) {
+	remaining := []netip.Prefix{}
+	var subtract func(p netip.Prefix)
+	subtract = func(p netip.Prefix) {
+		if ps.Encompasses(p) {
+			return
+		}
+		if !ps.OverlapsPrefix(p) {
+			remaining = append(remaining, p)
+			return
+		}
+		if p.Bits() < p.Addr().BitLen() {
+			lo, hi := SplitPrefix(p)
+			subtract(lo)
+			subtract(hi)
+		}
+	}
+	for _, p := range psb.PrefixSet().PrefixesCompact() {
+		subtract(p.Masked())
+	}
+
+	*psb = netipds.PrefixSetBuilder{}
+	for _, p := range remaining {
+		psb.Add(p)
+	}
+}
+
+// PrefixSetEntryFor returns the longest-prefix match of p in ps. If p has no
+// ancestor in ps, then the first Prefix in ps contained by p is returned.
+func PrefixSetEntryFor(ps *netipds.PrefixSet, p netip.Prefix) (netip.Prefix, bool) {
+	if parent, ok := ps.ParentOf(p.Masked()); ok {
+		return parent, true
+	}
+	if descendants := ps.DescendantsOf(p.Masked()).Prefixes(); len(descendants) > 0 {
+		return descendants[0], true
+	}
+	return netip.Prefix{}, false
+}
+
 // StrSliceToPrefixSlice converts a slice of CIDR strings to a slice of Prefixes.
 func StrSliceToPrefixSlice(cidrStrs []string) ([]netip.Prefix, error) {
 	prefixes := make([]netip.Prefix, len(cidrStrs))
@@ -72,9 +218,22 @@ func ToSliceOfOneFn[A, B any](fn func(A) (B, error)) func(A) ([]B, error) {
 	}
 }
 
-// ParsePrefixOrAddr parses a string as a CIDR prefix or an IP address.
-func ParsePrefixOrAddr(s string) (netip.Prefix, error) {
-	return netip.ParsePrefix(EnsurePrefix(s))
+// ParsePrefixOrAddr parses a string as a CIDR prefix, an IP address, or a
+// range of IP addresses (e.g. 10.0.0.5-10.0.1.200). A range is converted into
+// the minimal set of Prefixes covering exactly that range.
+func ParsePrefixOrAddr(s string) ([]netip.Prefix, error) {
+	if strings.Contains(s, "-") {
+		r, err := ParseRange(s)
+		if err != nil {
+			return nil, err
+		}
+		return r.Prefixes(), nil
+	}
+	p, err := netip.ParsePrefix(EnsurePrefix(s))
+	if err != nil {
+		return nil, err
+	}
+	return []netip.Prefix{p}, nil
 }
 
 // ParseHost parses a string as an IP with an optional :port suffix and returns
@@ -98,18 +257,18 @@ func ParseUrl(s string) (netip.Prefix, error) {
 	return netip.ParsePrefix(EnsurePrefix(u.Hostname()))
 }
 
-func ValParser(acceptUrl bool, acceptHostPort bool) func(string) (netip.Prefix, error) {
-	return func(s string) (netip.Prefix, error) {
+func ValParser(acceptUrl bool, acceptHostPort bool) func(string) ([]netip.Prefix, error) {
+	return func(s string) ([]netip.Prefix, error) {
 		var err error
-		var p netip.Prefix
+		var p []netip.Prefix
 		if acceptUrl {
-			p, err = ParseUrl(s)
+			p, err = ToSliceOfOneFn(ParseUrl)(s)
 			if err == nil {
 				return p, nil
 			}
 		}
 		if acceptHostPort {
-			p, err = ParseHost(s)
+			p, err = ToSliceOfOneFn(ParseHost)(s)
 			if err == nil {
 				return p, nil
 			}
@@ -118,6 +277,51 @@ func ValParser(acceptUrl bool, acceptHostPort bool) func(string) (netip.Prefix,
 	}
 }
 
+// PrefixSetBuilderFromStrings parses each of cidrStrs as a CIDR or IP and adds
+// it to a new PrefixSetBuilder.
+func PrefixSetBuilderFromStrings(cidrStrs []string) (*netipds.PrefixSetBuilder, error) {
+	psb := netipds.PrefixSetBuilder{}
+	for _, s := range cidrStrs {
+		prefixes, err := ParsePrefixOrAddr(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range prefixes {
+			psb.Add(p)
+		}
+	}
+	return &psb, nil
+}
+
+// LoadPrefixSetBuilder loads a PrefixSetBuilder from a list argument, which
+// is either a path to a file or the name of a built-in set prefixed with '@'
+// (e.g. @rfc1918).
+func LoadPrefixSetBuilder(
+	arg string,
+	errFn func(string, error) error,
+) (*netipds.PrefixSetBuilder, error) {
+	if name, found := strings.CutPrefix(arg, "@"); found {
+		cidrStrs, ok := namedSets[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown named set '%s'", arg)
+		}
+		return PrefixSetBuilderFromStrings(cidrStrs)
+	}
+	return LoadPrefixSetBuilderFromFile(arg, errFn)
+}
+
+// LoadPrefixSet is like LoadPrefixSetBuilder, but returns a PrefixSet.
+func LoadPrefixSet(
+	arg string,
+	errFn func(string, error) error,
+) (*netipds.PrefixSet, error) {
+	psb, err := LoadPrefixSetBuilder(arg, errFn)
+	if err != nil {
+		return nil, err
+	}
+	return psb.PrefixSet(), nil
+}
+
 func LoadPrefixSetBuilderFromFile(
 	path string,
 	errFn func(string, error) error,
@@ -158,3 +362,91 @@ func LoadPrefixSetFromFile(
 	}
 	return psb.PrefixSet(), nil
 }
+
+// LoadPrefixMapFromFile loads a PrefixMap from a file of rows of the form
+// CIDR<delimiter>VALUE, where VALUE is the remainder of the row after the
+// first delimiter (or empty, if the row has no delimiter). If a CIDR appears in
+// multiple rows, the last row wins.
+func LoadPrefixMapFromFile(
+	path string,
+	delimiter string,
+	errFn func(string, error) error,
+) (*netipds.PrefixMap[string], error) {
+	pmb := netipds.PrefixMapBuilder[string]{}
+	delimiter = UnescapeDelimiter(delimiter)
+
+	p := CidrProcessor{
+		Fields:    []int{1},
+		Delimiter: delimiter,
+		ValParser: ParsePrefixOrAddr,
+		HandlerFn: func(parsed *ParsedLine) error {
+			_, value, _ := strings.Cut(parsed.Raw, delimiter)
+			for _, prefix := range parsed.Prefixes {
+				if err := pmb.Set(prefix.Masked(), value); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		ErrFn: errFn,
+	}
+
+	r, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	err = p.Process(r)
+	if err != nil {
+		return nil, err
+	}
+	return pmb.PrefixMap(), nil
+}
+
+// AppendLinesAtomic appends lines to the file at path by writing the file's
+// existing contents and the new lines to a temporary file in the same
+// directory, then renaming it over the original. Readers therefore see either
+// the old or the new contents, never a partial write. If the file does not
+// exist, it is created.
+func AppendLinesAtomic(path string, lines []string) error {
+	old, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	perm := fs.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if len(old) > 0 && old[len(old)-1] != '\n' {
+		old = append(old, '\n')
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err = tmp.Write(old); err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if _, err = fmt.Fprintln(tmp, line); err != nil {
+			return err
+		}
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
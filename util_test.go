@@ -0,0 +1,181 @@
+package main
+
+import (
+	"math/rand"
+	"net/netip"
+	"testing"
+
+	"github.com/aromatt/netipds"
+)
+
+// randomPrefixes returns n random Prefixes within 10.0.0.0/24, which is small
+// enough for results to be checked address by address.
+func randomPrefixes(rng *rand.Rand, n int) []netip.Prefix {
+	prefixes := make([]netip.Prefix, n)
+	for i := range prefixes {
+		addr := netip.AddrFrom4([4]byte{10, 0, 0, byte(rng.Intn(256))})
+		prefixes[i] = netip.PrefixFrom(addr, 24+rng.Intn(9)).Masked()
+	}
+	return prefixes
+}
+
+// addrSet returns the set of individual addresses covered by prefixes.
+func addrSet(prefixes ...netip.Prefix) map[netip.Addr]bool {
+	addrs := map[netip.Addr]bool{}
+	for _, p := range prefixes {
+		for a := p.Masked().Addr(); a.IsValid() && p.Contains(a); a = a.Next() {
+			addrs[a] = true
+		}
+	}
+	return addrs
+}
+
+func prefixSetOf(prefixes ...netip.Prefix) *netipds.PrefixSet {
+	psb := netipds.PrefixSetBuilder{}
+	for _, p := range prefixes {
+		psb.Add(p)
+	}
+	return psb.PrefixSet()
+}
+
+func mustParsePrefixes(strs ...string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, len(strs))
+	for i, s := range strs {
+		prefixes[i] = netip.MustParsePrefix(EnsurePrefix(s))
+	}
+	return prefixes
+}
+
+func TestPrefixSetCovers(t *testing.T) {
+	tests := []struct {
+		set  []string
+		p    string
+		want bool
+	}{
+		{[]string{"10.0.0.0/25", "10.0.0.128/25"}, "10.0.0.0/24", true},
+		{[]string{"10.0.0.0/25", "10.0.0.128/26"}, "10.0.0.0/24", false},
+		{[]string{"10.0.0.0/24"}, "10.0.0.5", true},
+		{[]string{"10.0.0.0/24"}, "10.0.0.0/23", false},
+		{[]string{"10.0.0.0/26", "10.0.0.64/26", "10.0.0.128/25"}, "10.0.0.0/24", true},
+		{[]string{}, "10.0.0.0/24", false},
+	}
+	for _, tt := range tests {
+		ps := prefixSetOf(mustParsePrefixes(tt.set...)...)
+		p := netip.MustParsePrefix(EnsurePrefix(tt.p))
+		if got := PrefixSetCovers(ps, p); got != tt.want {
+			t.Errorf("PrefixSetCovers(%v, %s) = %v, want %v", tt.set, tt.p, got, tt.want)
+		}
+	}
+
+	// Compare against a brute-force check of every address
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		set := randomPrefixes(rng, 1+rng.Intn(8))
+		p := randomPrefixes(rng, 1)[0]
+		covered := addrSet(set...)
+		want := true
+		for a := range addrSet(p) {
+			want = want && covered[a]
+		}
+		if got := PrefixSetCovers(prefixSetOf(set...), p); got != want {
+			t.Fatalf("PrefixSetCovers(%v, %s) = %v, want %v", set, p, got, want)
+		}
+	}
+}
+
+func TestPrefixSetCoverage(t *testing.T) {
+	tests := []struct {
+		set  []string
+		p    string
+		want float64
+	}{
+		{[]string{"10.0.0.0/25", "10.0.0.128/25"}, "10.0.0.0/24", 1},
+		{[]string{"10.0.0.0/25", "10.0.0.128/26"}, "10.0.0.0/24", 0.75},
+		{[]string{"10.0.0.0/26", "10.0.0.0/27"}, "10.0.0.0/24", 0.25},
+		{[]string{"10.0.0.0/23"}, "10.0.0.0/24", 1},
+		{[]string{"10.0.1.0/24"}, "10.0.0.0/24", 0},
+	}
+	for _, tt := range tests {
+		ps := prefixSetOf(mustParsePrefixes(tt.set...)...)
+		p := netip.MustParsePrefix(tt.p)
+		if got := PrefixSetCoverage(ps, p); got != tt.want {
+			t.Errorf("PrefixSetCoverage(%v, %s) = %v, want %v", tt.set, tt.p, got, tt.want)
+		}
+	}
+
+	// Compare against a brute-force count of covered addresses
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		set := randomPrefixes(rng, 1+rng.Intn(8))
+		p := randomPrefixes(rng, 1)[0]
+		covered := addrSet(set...)
+		addrs := addrSet(p)
+		n := 0
+		for a := range addrs {
+			if covered[a] {
+				n++
+			}
+		}
+		want := float64(n) / float64(len(addrs))
+		if got := PrefixSetCoverage(prefixSetOf(set...), p); got != want {
+			t.Fatalf("PrefixSetCoverage(%v, %s) = %v, want %v", set, p, got, want)
+		}
+	}
+}
+
+func TestPrefixSetBuilderSubtract(t *testing.T) {
+	tests := []struct {
+		from, subtract []string
+	}{
+		{
+			[]string{"10.0.0.0/21", "10.0.0.0/23", "10.0.2.128/25", "10.0.3.216/29"},
+			[]string{"10.0.3.170/31"},
+		},
+		{
+			[]string{"10.0.0.0/24", "10.1.0.0/26"},
+			[]string{"10.0.0.0/26", "10.0.0.128/27"},
+		},
+		{
+			[]string{"10.0.0.0/25"},
+			[]string{"10.0.0.0/23", "10.0.3.165"},
+		},
+		{
+			[]string{"10.0.0.0/24"},
+			[]string{},
+		},
+	}
+	check := func(from, subtract []netip.Prefix) {
+		t.Helper()
+		psb := netipds.PrefixSetBuilder{}
+		for _, p := range from {
+			psb.Add(p)
+		}
+		PrefixSetBuilderSubtract(&psb, prefixSetOf(subtract...))
+		got := addrSet(psb.PrefixSet().PrefixesCompact()...)
+		removed := addrSet(subtract...)
+		want := addrSet(from...)
+		for a := range want {
+			if removed[a] {
+				delete(want, a)
+			}
+		}
+		if len(got) != len(want) {
+			t.Fatalf("%v minus %v: got %d addresses, want %d (%v)",
+				from, subtract, len(got), len(want), psb.PrefixSet().PrefixesCompact())
+		}
+		for a := range want {
+			if !got[a] {
+				t.Fatalf("%v minus %v: missing %s", from, subtract, a)
+			}
+		}
+	}
+	for _, tt := range tests {
+		check(mustParsePrefixes(tt.from...), mustParsePrefixes(tt.subtract...))
+	}
+
+	// Compare against brute-force subtraction of every address
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		check(randomPrefixes(rng, 1+rng.Intn(8)), randomPrefixes(rng, rng.Intn(8)))
+	}
+}